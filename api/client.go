@@ -5,12 +5,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
+// maxBufferSize is the longest line of a streamed response the client reads.
+const maxBufferSize = 32 << 20
+
 type Client struct {
 	base    url.URL
 	HTTP    http.Client
@@ -22,12 +27,17 @@ func checkError(resp *http.Response, body []byte) error {
 		return nil
 	}
 
-	apiError := StatusError{StatusCode: resp.StatusCode}
+	apiError := StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 
-	err := json.Unmarshal(body, &apiError)
-	if err != nil {
+	var errorResponse struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &errorResponse); err != nil || errorResponse.Error == "" {
 		// Use the full body as the message if we fail to decode a response.
 		apiError.Message = string(body)
+	} else {
+		apiError.Message = errorResponse.Error
 	}
 
 	return apiError
@@ -120,13 +130,28 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	}
 	defer response.Body.Close()
 
+	sse := strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream")
+
 	scanner := bufio.NewScanner(response.Body)
+	// a response that isn't streamed is a single line, which may be long
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxBufferSize)
 	for scanner.Scan() {
 		var errorResponse struct {
 			Error string `json:"error,omitempty"`
 		}
 
 		bts := scanner.Bytes()
+		if sse {
+			// events are a data line followed by a blank line; anything else
+			// is a blank line, a keep-alive comment or an unused field
+			data, ok := bytes.CutPrefix(bts, []byte("data:"))
+			if !ok {
+				continue
+			}
+
+			bts = bytes.TrimPrefix(data, []byte(" "))
+		}
+
 		if err := json.Unmarshal(bts, &errorResponse); err != nil {
 			return fmt.Errorf("unmarshal: %w", err)
 		}
@@ -139,12 +164,21 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			}
 		}
 
+		if errorResponse.Error != "" {
+			return errors.New(errorResponse.Error)
+		}
+
 		if err := fn(bts); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if err := ctx.Err(); err != nil {
+		// the request was cancelled; report that rather than the read error
+		return err
+	}
+
+	return scanner.Err()
 }
 
 type GenerateResponseFunc func(GenerateResponse) error
@@ -160,6 +194,79 @@ func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn Generate
 	})
 }
 
+type ChatResponseFunc func(ChatResponse) error
+
+func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/chat", req, func(bts []byte) error {
+		var resp ChatResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+func (c *Client) CreateSession(ctx context.Context, req *SessionRequest) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/sessions", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) GetSession(ctx context.Context, id string) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions/"+id, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions/"+id, nil, nil)
+}
+
+func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
+	var resp EmbeddingResponse
+	if err := c.do(ctx, http.MethodPost, "/api/embeddings", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Score(ctx context.Context, req *ScoreRequest) (*ScoreResponse, error) {
+	var resp ScoreResponse
+	if err := c.do(ctx, http.MethodPost, "/api/score", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Vocab(ctx context.Context, req *VocabRequest) (*VocabResponse, error) {
+	var resp VocabResponse
+	if err := c.do(ctx, http.MethodPost, "/api/vocab", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 type PullProgressFunc func(PullProgress) error
 
 func (c *Client) Pull(ctx context.Context, req *PullRequest, fn PullProgressFunc) error {
@@ -199,6 +306,22 @@ func (c *Client) Create(ctx context.Context, req *CreateRequest, fn CreateProgre
 	})
 }
 
+func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
+	var resp ShowResponse
+	if err := c.do(ctx, http.MethodPost, "/api/show", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/copy", req, nil)
+}
+
+func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/delete", req, nil)
+}
+
 func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	var lr ListResponse
 	if err := c.do(ctx, http.MethodGet, "/api/tags", nil, &lr); err != nil {
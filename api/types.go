@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
@@ -24,13 +26,165 @@ type GenerateRequest struct {
 	Model   string `json:"model"`
 	Prompt  string `json:"prompt"`
 	Context []int  `json:"context,omitempty"`
+	Session string `json:"session,omitempty"`
+
+	// Format constrains the response to "json", a JSON schema object or a
+	// grammar string
+	Format json.RawMessage `json:"format,omitempty"`
+
+	// Stream defaults to true; if false the response is a single object
+	Stream *bool `json:"stream,omitempty"`
 
 	Options `json:"options"`
 }
 
+// Message is a turn of a conversation. Role is "system", "user" or
+// "assistant".
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+
+	// Format constrains the response like GenerateRequest.Format
+	Format json.RawMessage `json:"format,omitempty"`
+
+	// Stream defaults to true; if false the response is a single object
+	Stream *bool `json:"stream,omitempty"`
+
+	Options `json:"options"`
+}
+
+type ChatResponse struct {
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"created_at"`
+	Message   *Message  `json:"message,omitempty"`
+
+	Index  int            `json:"index"`
+	Tokens []TokenLogprob `json:"tokens,omitempty"`
+
+	Done       bool   `json:"done"`
+	DoneReason string `json:"done_reason,omitempty"`
+
+	TotalDuration      time.Duration `json:"total_duration,omitempty"`
+	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int           `json:"eval_count,omitempty"`
+	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+}
+
+type SessionRequest struct {
+	Model   string `json:"model"`
+	Context []int  `json:"context,omitempty"`
+}
+
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Model      string    `json:"model"`
+	Context    []int     `json:"context,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// StringOrList accepts either a string or a list of strings.
+type StringOrList []string
+
+func (s *StringOrList) UnmarshalJSON(b []byte) error {
+	// null leaves the value unset, as it does for other types
+	if string(b) == "null" {
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*s = []string{str}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("expected a string or a list of strings")
+	}
+
+	*s = list
+	return nil
+}
+
+type EmbeddingRequest struct {
+	Model string       `json:"model"`
+	Input StringOrList `json:"input"`
+
+	Options `json:"options"`
+}
+
+type EmbeddingResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+type ScoreRequest struct {
+	Model      string   `json:"model"`
+	Prompt     string   `json:"prompt"`
+	Candidates []string `json:"candidates"`
+
+	Options `json:"options"`
+}
+
+type ScoreResponse struct {
+	Model  string  `json:"model"`
+	Scores []Score `json:"scores"`
+}
+
+// Score is the log likelihood of a candidate continuing the prompt, in
+// total and for each of its tokens.
+type Score struct {
+	Candidate string    `json:"candidate"`
+	Logprob   float64   `json:"logprob"`
+	Tokens    []Logprob `json:"tokens"`
+}
+
+type TokenizeRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+}
+
+type DetokenizeRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+type DetokenizeResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+type VocabRequest struct {
+	Model  string `json:"model"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type VocabResponse struct {
+	Total  int          `json:"total"`
+	Tokens []VocabEntry `json:"tokens"`
+}
+
+type VocabEntry struct {
+	ID    int     `json:"id"`
+	Text  string  `json:"text"`
+	Score float32 `json:"score"`
+}
+
 type CreateRequest struct {
-	Name string `json:"name"`
-	Path string `json:"path"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Stream *bool  `json:"stream,omitempty"`
 }
 
 type CreateProgress struct {
@@ -41,6 +195,7 @@ type PullRequest struct {
 	Name     string `json:"name"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Stream   *bool  `json:"stream,omitempty"`
 }
 
 type PullProgress struct {
@@ -55,6 +210,7 @@ type PushRequest struct {
 	Name     string `json:"name"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Stream   *bool  `json:"stream,omitempty"`
 }
 
 type PushProgress struct {
@@ -65,6 +221,27 @@ type PushProgress struct {
 	Percent   float64 `json:"percent,omitempty"`
 }
 
+type ShowRequest struct {
+	Name string `json:"name"`
+}
+
+type ShowResponse struct {
+	Manifest   json.RawMessage `json:"manifest"`
+	Modelfile  string          `json:"modelfile"`
+	Prompt     string          `json:"prompt,omitempty"`
+	Template   string          `json:"template,omitempty"`
+	Parameters map[string]any  `json:"parameters,omitempty"`
+}
+
+type CopyRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+type DeleteRequest struct {
+	Name string `json:"name"`
+}
+
 type ListResponse struct {
 	Models []ListResponseModel `json:"models"`
 }
@@ -80,8 +257,16 @@ type GenerateResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response,omitempty"`
 
-	Done    bool  `json:"done"`
-	Context []int `json:"context,omitempty"`
+	// Index is the completion the response belongs to if n is set
+	Index int `json:"index"`
+
+	// Tokens holds the log probabilities of the tokens making up Response
+	// if logprobs or top_logprobs is set
+	Tokens []TokenLogprob `json:"tokens,omitempty"`
+
+	Done       bool   `json:"done"`
+	DoneReason string `json:"done_reason,omitempty"`
+	Context    []int  `json:"context,omitempty"`
 
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
@@ -90,6 +275,32 @@ type GenerateResponse struct {
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
 }
 
+type Logprob struct {
+	ID      int     `json:"id"`
+	Text    string  `json:"text"`
+	Logprob float32 `json:"logprob"`
+}
+
+type TokenLogprob struct {
+	Logprob
+	TopLogprobs []Logprob `json:"top_logprobs,omitempty"`
+}
+
+// Reasons reported in DoneReason of the final GenerateResponse.
+const (
+	// DoneReasonStop means the model produced an end of sequence token or a
+	// stop sequence.
+	DoneReasonStop = "stop"
+	// DoneReasonLength means the response reached NumPredict tokens.
+	DoneReasonLength = "length"
+	// DoneReasonContextFull means the context window filled up.
+	DoneReasonContextFull = "context_full"
+	// DoneReasonCancelled means the request was cancelled.
+	DoneReasonCancelled = "cancelled"
+	// DoneReasonError means generation failed.
+	DoneReasonError = "error"
+)
+
 func (r *GenerateResponse) Summary() {
 	if r.TotalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "total duration:       %v\n", r.TotalDuration)
@@ -134,18 +345,28 @@ type Options struct {
 	EmbeddingOnly bool `json:"embedding_only,omitempty"`
 
 	// Predict options
-	RepeatLastN      int     `json:"repeat_last_n,omitempty"`
-	RepeatPenalty    float32 `json:"repeat_penalty,omitempty"`
-	FrequencyPenalty float32 `json:"frequency_penalty,omitempty"`
-	PresencePenalty  float32 `json:"presence_penalty,omitempty"`
-	Temperature      float32 `json:"temperature,omitempty"`
-	TopK             int     `json:"top_k,omitempty"`
-	TopP             float32 `json:"top_p,omitempty"`
-	TFSZ             float32 `json:"tfs_z,omitempty"`
-	TypicalP         float32 `json:"typical_p,omitempty"`
-	Mirostat         int     `json:"mirostat,omitempty"`
-	MirostatTau      float32 `json:"mirostat_tau,omitempty"`
-	MirostatEta      float32 `json:"mirostat_eta,omitempty"`
+	RepeatLastN      int                `json:"repeat_last_n,omitempty"`
+	RepeatPenalty    float32            `json:"repeat_penalty,omitempty"`
+	FrequencyPenalty float32            `json:"frequency_penalty,omitempty"`
+	PresencePenalty  float32            `json:"presence_penalty,omitempty"`
+	Temperature      float32            `json:"temperature,omitempty"`
+	TopK             int                `json:"top_k,omitempty"`
+	TopP             float32            `json:"top_p,omitempty"`
+	TFSZ             float32            `json:"tfs_z,omitempty"`
+	TypicalP         float32            `json:"typical_p,omitempty"`
+	Mirostat         int                `json:"mirostat,omitempty"`
+	MirostatTau      float32            `json:"mirostat_tau,omitempty"`
+	MirostatEta      float32            `json:"mirostat_eta,omitempty"`
+	NumKeep          int                `json:"num_keep,omitempty"`
+	ContextShift     bool               `json:"context_shift,omitempty"`
+	NumPredict       int                `json:"num_predict,omitempty"`
+	Stop             []string           `json:"stop,omitempty"`
+	LogitBias        map[string]float32 `json:"logit_bias,omitempty"`
+	NegativePrompt   string             `json:"negative_prompt,omitempty"`
+	CFGScale         float32            `json:"cfg_scale,omitempty"`
+	Logprobs         bool               `json:"logprobs,omitempty"`
+	TopLogprobs      int                `json:"top_logprobs,omitempty"`
+	N                int                `json:"n,omitempty"`
 
 	NumThread int `json:"num_thread,omitempty"`
 }
@@ -176,6 +397,8 @@ func DefaultOptions() Options {
 		Mirostat:         0,
 		MirostatTau:      5.0,
 		MirostatEta:      0.1,
+		NumPredict:       -1,
+		CFGScale:         1.0,
 
 		NumThread: runtime.NumCPU(),
 	}
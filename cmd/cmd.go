@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -122,6 +123,93 @@ func list(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func show(cmd *cobra.Command, args []string) error {
+	var flags []string
+	for _, name := range []string{"modelfile", "template", "chat-template", "parameters"} {
+		if set, _ := cmd.Flags().GetBool(name); set {
+			flags = append(flags, name)
+		}
+	}
+
+	if len(flags) > 1 {
+		return errors.New("only one of --modelfile, --template, --chat-template or --parameters can be set")
+	}
+
+	client := api.NewClient()
+
+	resp, err := client.Show(context.Background(), &api.ShowRequest{Name: args[0]})
+	if err != nil {
+		return err
+	}
+
+	if len(flags) == 0 {
+		flags = append(flags, "modelfile")
+	}
+
+	switch flags[0] {
+	case "template":
+		fmt.Println(resp.Prompt)
+	case "chat-template":
+		fmt.Println(resp.Template)
+	case "parameters":
+		names := make([]string, 0, len(resp.Parameters))
+		for name := range resp.Parameters {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		var data [][]string
+		for _, name := range names {
+			switch v := resp.Parameters[name].(type) {
+			case []any:
+				for _, s := range v {
+					data = append(data, []string{name, fmt.Sprintf("%q", s)})
+				}
+			default:
+				data = append(data, []string{name, fmt.Sprint(v)})
+			}
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetAlignment(tablewriter.ALIGN_LEFT)
+		table.SetBorder(false)
+		table.SetNoWhiteSpace(true)
+		table.SetTablePadding("\t")
+		table.AppendBulk(data)
+		table.Render()
+	default:
+		fmt.Print(resp.Modelfile)
+	}
+
+	return nil
+}
+
+func copyModel(cmd *cobra.Command, args []string) error {
+	client := api.NewClient()
+
+	if err := client.Copy(context.Background(), &api.CopyRequest{Source: args[0], Destination: args[1]}); err != nil {
+		return err
+	}
+
+	fmt.Printf("copied '%s' to '%s'\n", args[0], args[1])
+	return nil
+}
+
+func remove(cmd *cobra.Command, args []string) error {
+	client := api.NewClient()
+
+	for _, name := range args {
+		if err := client.Delete(context.Background(), &api.DeleteRequest{Name: name}); err != nil {
+			return err
+		}
+
+		fmt.Printf("deleted '%s'\n", name)
+	}
+
+	return nil
+}
+
 func RunPull(cmd *cobra.Command, args []string) error {
 	return pull(args[0])
 }
@@ -327,13 +415,42 @@ func NewCLI() *cobra.Command {
 		RunE:  list,
 	}
 
+	showCmd := &cobra.Command{
+		Use:   "show MODEL",
+		Short: "Show information for a model",
+		Args:  cobra.ExactArgs(1),
+		RunE:  show,
+	}
+
+	showCmd.Flags().Bool("modelfile", false, "Show the Modelfile of a model (default)")
+	showCmd.Flags().Bool("template", false, "Show the prompt template of a model, set by PROMPT")
+	showCmd.Flags().Bool("chat-template", false, "Show the chat template of a model, set by TEMPLATE")
+	showCmd.Flags().Bool("parameters", false, "Show the parameters of a model")
+
+	copyCmd := &cobra.Command{
+		Use:   "cp SOURCE DESTINATION",
+		Short: "Copy a model",
+		Args:  cobra.ExactArgs(2),
+		RunE:  copyModel,
+	}
+
+	removeCmd := &cobra.Command{
+		Use:   "rm MODEL [MODEL...]",
+		Short: "Remove a model",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  remove,
+	}
+
 	rootCmd.AddCommand(
 		serveCmd,
 		createCmd,
+		showCmd,
 		runCmd,
 		pullCmd,
 		pushCmd,
 		listCmd,
+		copyCmd,
+		removeCmd,
 	)
 
 	return rootCmd
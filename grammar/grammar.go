@@ -0,0 +1,492 @@
+// Package grammar constrains generated text to a context-free grammar.
+//
+// Grammars are written in GBNF, the notation used by llama.cpp:
+//
+//	root   ::= "yes" | "no" | answer
+//	answer ::= [a-z]+ ("," ws [a-z]+)*
+//	ws     ::= [ \t\n]*
+//
+// A rule is a name followed by ::= and alternatives separated by |. An
+// alternative is a sequence of string literals, character classes such as
+// [a-z] or [^"], the wildcard ., references to other rules and groups in
+// parentheses. Any item may be followed by *, + or ?. Comments start with #.
+// Generation starts from the rule named root.
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type runeRange struct {
+	lo, hi rune
+}
+
+// element is a single step of an alternative: either a character class or,
+// if ref is not negative, a reference to another rule.
+type element struct {
+	ref    int
+	ranges []runeRange
+	negate bool
+}
+
+func (e element) matches(r rune) bool {
+	var in bool
+	for _, rr := range e.ranges {
+		if rr.lo <= r && r <= rr.hi {
+			in = true
+			break
+		}
+	}
+
+	return in != e.negate
+}
+
+type alternative []element
+
+// Grammar is a compiled grammar. It is safe for concurrent use; each
+// generation tracks its progress with its own Matcher.
+type Grammar struct {
+	names []string
+	rules [][]alternative
+	root  int
+}
+
+// Parse compiles a grammar written in GBNF.
+func Parse(src string) (*Grammar, error) {
+	p := parser{src: src, index: make(map[string]int)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	g := &Grammar{names: p.names, rules: p.rules}
+	for i, defined := range p.defined {
+		if !defined {
+			return nil, fmt.Errorf("grammar: undefined rule %q", p.names[i])
+		}
+	}
+
+	root, ok := p.index["root"]
+	if !ok {
+		return nil, errors.New("grammar: missing root rule")
+	}
+
+	g.root = root
+	if err := g.checkLeftRecursion(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// nullable reports which rules can match the empty string.
+func (g *Grammar) nullable() []bool {
+	nullable := make([]bool, len(g.rules))
+	for changed := true; changed; {
+		changed = false
+		for i, alts := range g.rules {
+			if nullable[i] {
+				continue
+			}
+
+			for _, alt := range alts {
+				all := true
+				for _, e := range alt {
+					if e.ref < 0 || !nullable[e.ref] {
+						all = false
+						break
+					}
+				}
+
+				if all {
+					nullable[i] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return nullable
+}
+
+// checkLeftRecursion rejects grammars where a rule can reach itself without
+// consuming input, since matching them would never terminate.
+func (g *Grammar) checkLeftRecursion() error {
+	nullable := g.nullable()
+
+	// edges[i] holds the rules that can start rule i
+	edges := make([][]int, len(g.rules))
+	for i, alts := range g.rules {
+		for _, alt := range alts {
+			for _, e := range alt {
+				if e.ref < 0 {
+					break
+				}
+
+				edges[i] = append(edges[i], e.ref)
+				if !nullable[e.ref] {
+					break
+				}
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(g.rules))
+	var visit func(int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("grammar: rule %q is left recursive", g.names[i])
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		for _, j := range edges[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+
+		state[i] = visited
+		return nil
+	}
+
+	for i := range g.rules {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type parser struct {
+	src string
+	pos int
+
+	names   []string
+	rules   [][]alternative
+	defined []bool
+	index   map[string]int
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("grammar: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// rule returns the index of the named rule, adding it if necessary.
+func (p *parser) rule(name string) int {
+	if i, ok := p.index[name]; ok {
+		return i
+	}
+
+	p.index[name] = len(p.names)
+	p.names = append(p.names, name)
+	p.rules = append(p.rules, nil)
+	p.defined = append(p.defined, false)
+	return len(p.names) - 1
+}
+
+// anonymous adds a rule for a group or repetition.
+func (p *parser) anonymous(alts []alternative) int {
+	i := p.rule(p.anonymousName())
+	p.rules[i] = alts
+	p.defined[i] = true
+	return i
+}
+
+// anonymousName names generated rules with characters that can't appear in
+// the names of rules in the source.
+func (p *parser) anonymousName() string {
+	return fmt.Sprintf("(%d)", len(p.names))
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isNameChar(c byte) bool {
+	return c == '-' || c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+
+	return p.src[start:p.pos]
+}
+
+// atDefinition reports whether the input continues with "name ::=".
+func (p *parser) atDefinition() bool {
+	pos := p.pos
+	defer func() { p.pos = pos }()
+
+	if p.name() == "" {
+		return false
+	}
+
+	p.skipSpace()
+	return strings.HasPrefix(p.src[p.pos:], "::=")
+}
+
+func (p *parser) parse() error {
+	for p.skipSpace(); p.pos < len(p.src); p.skipSpace() {
+		name := p.name()
+		if name == "" {
+			return p.errorf("expected rule name")
+		}
+
+		p.skipSpace()
+		if !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return p.errorf("expected ::= after %s", name)
+		}
+
+		p.pos += len("::=")
+
+		i := p.rule(name)
+		if p.defined[i] {
+			return p.errorf("rule %s is defined twice", name)
+		}
+
+		alts, err := p.alternatives()
+		if err != nil {
+			return err
+		}
+
+		p.rules[i] = alts
+		p.defined[i] = true
+	}
+
+	return nil
+}
+
+func (p *parser) alternatives() ([]alternative, error) {
+	var alts []alternative
+	for {
+		alt, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+
+		alts = append(alts, alt)
+
+		p.skipSpace()
+		if p.pos < len(p.src) && p.src[p.pos] == '|' {
+			p.pos++
+			continue
+		}
+
+		return alts, nil
+	}
+}
+
+func (p *parser) sequence() (alternative, error) {
+	var alt alternative
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return alt, nil
+		}
+
+		var items alternative
+		switch c := p.src[p.pos]; {
+		case c == '|' || c == ')':
+			return alt, nil
+		case c == '"':
+			literal, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+
+			items = literal
+		case c == '[':
+			class, err := p.class()
+			if err != nil {
+				return nil, err
+			}
+
+			items = alternative{class}
+		case c == '.':
+			p.pos++
+			items = alternative{{ref: -1, negate: true}}
+		case c == '(':
+			p.pos++
+			alts, err := p.alternatives()
+			if err != nil {
+				return nil, err
+			}
+
+			if p.pos >= len(p.src) || p.src[p.pos] != ')' {
+				return nil, p.errorf("expected )")
+			}
+
+			p.pos++
+			items = alternative{{ref: p.anonymous(alts)}}
+		case isNameChar(c):
+			if p.atDefinition() {
+				return alt, nil
+			}
+
+			items = alternative{{ref: p.rule(p.name())}}
+		default:
+			return nil, p.errorf("unexpected %q", c)
+		}
+
+	postfix:
+		for p.pos < len(p.src) {
+			switch p.src[p.pos] {
+			case '*':
+				// x* ::= x x* | ε
+				i := p.rule(p.anonymousName())
+				p.rules[i] = []alternative{append(items, element{ref: i}), {}}
+				p.defined[i] = true
+				items = alternative{{ref: i}}
+			case '+':
+				// x+ ::= x x* where x* ::= x x* | ε
+				i := p.rule(p.anonymousName())
+				p.rules[i] = []alternative{append(append(alternative{}, items...), element{ref: i}), {}}
+				p.defined[i] = true
+				items = append(items, element{ref: i})
+			case '?':
+				items = alternative{{ref: p.anonymous([]alternative{items, {}})}}
+			default:
+				break postfix
+			}
+
+			p.pos++
+		}
+
+		alt = append(alt, items...)
+	}
+}
+
+func (p *parser) literal() (alternative, error) {
+	p.pos++ // opening quote
+
+	var alt alternative
+	for {
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated string")
+		}
+
+		if p.src[p.pos] == '"' {
+			p.pos++
+			return alt, nil
+		}
+
+		r, err := p.char()
+		if err != nil {
+			return nil, err
+		}
+
+		alt = append(alt, element{ref: -1, ranges: []runeRange{{r, r}}})
+	}
+}
+
+func (p *parser) class() (element, error) {
+	p.pos++ // opening bracket
+
+	e := element{ref: -1}
+	if p.pos < len(p.src) && p.src[p.pos] == '^' {
+		e.negate = true
+		p.pos++
+	}
+
+	for {
+		if p.pos >= len(p.src) {
+			return element{}, p.errorf("unterminated character class")
+		}
+
+		if p.src[p.pos] == ']' {
+			p.pos++
+			return e, nil
+		}
+
+		lo, err := p.char()
+		if err != nil {
+			return element{}, err
+		}
+
+		hi := lo
+		if p.pos+1 < len(p.src) && p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+			p.pos++
+			if hi, err = p.char(); err != nil {
+				return element{}, err
+			}
+		}
+
+		e.ranges = append(e.ranges, runeRange{lo, hi})
+	}
+}
+
+// char reads a possibly escaped character of a literal or class.
+func (p *parser) char() (rune, error) {
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	if r != '\\' {
+		return r, nil
+	}
+
+	if p.pos >= len(p.src) {
+		return 0, p.errorf("unterminated escape")
+	}
+
+	c := p.src[p.pos]
+	p.pos++
+
+	hex := func(n int) (rune, error) {
+		if p.pos+n > len(p.src) {
+			return 0, p.errorf("invalid escape")
+		}
+
+		v, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil {
+			return 0, p.errorf("invalid escape")
+		}
+
+		p.pos += n
+		return rune(v), nil
+	}
+
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'x':
+		return hex(2)
+	case 'u':
+		return hex(4)
+	case 'U':
+		return hex(8)
+	default:
+		return rune(c), nil
+	}
+}
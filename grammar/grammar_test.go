@@ -0,0 +1,237 @@
+package grammar
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// vocab is a stub vocabulary. Token 0 is the end of sequence token.
+var vocab = []string{
+	"</s>", "{", "}", "[", "]", "\"", ":", ",", " ", "\n",
+	"{\"", "\":", "\",", "a", "name", "age", "true", "null", "1", "12",
+	"-", ".", "x", "}}", "\xe2\x96", "é",
+}
+
+const eos = 0
+
+// allowed returns the tokens of vocab that m allows.
+func allowed(m *Matcher) []string {
+	var tokens []string
+	for i, ok := range m.Mask(vocab, eos) {
+		if ok {
+			tokens = append(tokens, vocab[i])
+		}
+	}
+
+	return tokens
+}
+
+func assertAllowed(t *testing.T, m *Matcher, want ...string) {
+	t.Helper()
+
+	got := allowed(m)
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func accept(t *testing.T, m *Matcher, texts ...string) {
+	t.Helper()
+
+	for _, text := range texts {
+		if err := m.Accept(text); err != nil {
+			t.Fatalf("accept %q: %v", text, err)
+		}
+	}
+}
+
+func TestMaskLiteral(t *testing.T) {
+	g, err := Parse(`root ::= "name" | "na" "me" ":" | "age"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := g.Matcher()
+	assertAllowed(t, m, "a", "name", "age")
+
+	accept(t, m, "name")
+	assertAllowed(t, m, "</s>", ":")
+
+	accept(t, m, ":")
+	assertAllowed(t, m, "</s>")
+}
+
+func TestMaskRepetition(t *testing.T) {
+	g, err := Parse(`
+		# one or more digits, optionally negative
+		root  ::= "-"? digit+
+		digit ::= [0-9]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := g.Matcher()
+	assertAllowed(t, m, "1", "12", "-")
+
+	accept(t, m, "-")
+	assertAllowed(t, m, "1", "12")
+
+	accept(t, m, "12")
+	assertAllowed(t, m, "</s>", "1", "12")
+}
+
+func TestMaskJSON(t *testing.T) {
+	m := JSON().Matcher()
+	assertAllowed(t, m, "{", "{\"")
+
+	// a token may open a string and continue inside it
+	accept(t, m, "{")
+	assertAllowed(t, m, "}", "\"", " ", "\n", "\":", "\",")
+
+	// or close a string and start the next part of the object
+	accept(t, m, "\"", "name", "\":", " ")
+	assertAllowed(t, m, "{", "[", "\"", " ", "\n", "{\"", "\":", "\",", "true", "null", "1", "12", "-")
+
+	accept(t, m, "\"", "a", "\",", "\"", "age", "\":", "12")
+	assertAllowed(t, m, "}", ",", " ", "\n", "1", "12", ".")
+
+	accept(t, m, "}")
+	if !m.Done() {
+		t.Fatal("expected object to be complete")
+	}
+
+	assertAllowed(t, m, "</s>")
+}
+
+func TestMaskJSONString(t *testing.T) {
+	m := JSON().Matcher()
+	accept(t, m, "{\"")
+
+	// anything but a control character may appear in a string, but tokens
+	// that are not valid UTF-8 are never allowed
+	for _, text := range []string{"a", "{", "}}", "é", " "} {
+		if !m.Allowed(text) {
+			t.Errorf("expected %q to be allowed", text)
+		}
+	}
+
+	for _, text := range []string{"\n", "\xe2\x96"} {
+		if m.Allowed(text) {
+			t.Errorf("expected %q to be rejected", text)
+		}
+	}
+}
+
+func TestAcceptRejected(t *testing.T) {
+	m := JSON().Matcher()
+	accept(t, m, "{")
+
+	if err := m.Accept("]"); err != ErrRejected {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+
+	// a rejected token leaves the matcher unchanged
+	assertAllowed(t, m, "}", "\"", " ", "\n", "\":", "\",")
+}
+
+func TestMaskJSONSchema(t *testing.T) {
+	g, err := FromJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"},
+			"tags": {"type": "array", "items": {"enum": ["a", 1]}}
+		},
+		"required": ["name", "age"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := g.Matcher()
+	assertAllowed(t, m, "{", "{\"")
+
+	accept(t, m, "{\"")
+	assertAllowed(t, m, "name")
+
+	accept(t, m, "name", "\":", " ", "\"", "x", "\",")
+	assertAllowed(t, m, "\"", " ", "\n")
+
+	accept(t, m, " ", "\"", "age", "\":", "1")
+
+	// integers have no fraction and the optional tags may follow
+	assertAllowed(t, m, "}", ",", " ", "\n", "1", "12")
+
+	accept(t, m, ",", "\"")
+	assertAllowed(t, m)
+
+	if err := m.Accept("tags\":["); err != nil {
+		t.Fatal(err)
+	}
+
+	assertAllowed(t, m, "]", "\"", " ", "\n", "1")
+	accept(t, m, "1", ",", "\"", "a", "\"", "]", "}")
+	assertAllowed(t, m, "</s>")
+}
+
+func TestFromFormat(t *testing.T) {
+	cases := []struct {
+		format string
+		text   string
+		ok     bool
+	}{
+		{`"json"`, `{"a": [1, true, null]}`, true},
+		{`"json"`, `[1]`, false},
+		{`{"type": "boolean"}`, `true`, true},
+		{`{"type": ["string", "null"]}`, `null`, true},
+		{`{"const": {"a": 1}}`, `{"a":1}`, true},
+		{`"root ::= [a-c]+"`, `abc`, true},
+		{`"root ::= [a-c]+"`, `abd`, false},
+		{`"root ::= [^a-c] ."`, `xé`, true},
+	}
+
+	for _, tt := range cases {
+		g, err := FromFormat(json.RawMessage(tt.format))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+
+		m := g.Matcher()
+		ok := m.Accept(tt.text) == nil && m.Done()
+		if ok != tt.ok {
+			t.Errorf("%s: expected %q to match %v, got %v", tt.format, tt.text, tt.ok, ok)
+		}
+	}
+
+	if g, err := FromFormat(nil); g != nil || err != nil {
+		t.Errorf("expected no grammar without a format, got %v, %v", g, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []string{
+		`value ::= "a"`,
+		`root ::= value`,
+		`root ::= "a`,
+		`root ::= [a-`,
+		`root ::= ( "a"`,
+		`root ::= root "a" | "b"`,
+		`root ::= x? root "a" | "b"
+		 x ::= "x"`,
+		`root ::= "a"
+		 root ::= "b"`,
+	}
+
+	for _, src := range cases {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("expected an error parsing %q", src)
+		}
+	}
+}
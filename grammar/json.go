@@ -0,0 +1,355 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// jsonRules are the JSON productions shared by JSON and JSON schema
+// grammars. Whitespace is allowed between tokens but not after the final
+// value so generation ends as soon as the value is complete.
+const jsonRules = `
+value   ::= object | array | string | number | boolean | null
+object  ::= "{" ws ( member ( ws "," ws member )* ws )? "}"
+member  ::= string ws ":" ws value
+array   ::= "[" ws ( value ( ws "," ws value )* ws )? "]"
+string  ::= "\"" ( [^"\\\x00-\x1f] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] ) )* "\""
+number  ::= integer ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?
+integer ::= "-"? ( "0" | [1-9] [0-9]* )
+boolean ::= "true" | "false"
+null    ::= "null"
+ws      ::= [ \t\n]*
+`
+
+// JSON returns a grammar matching a JSON object.
+func JSON() *Grammar {
+	g, err := Parse("root ::= object\n" + jsonRules)
+	if err != nil {
+		panic(err)
+	}
+
+	return g
+}
+
+// FromFormat returns the grammar for a generate request's format, which is
+// either the string "json", a JSON schema object or a string holding a GBNF
+// grammar.
+func FromFormat(format json.RawMessage) (*Grammar, error) {
+	format = bytes.TrimSpace(format)
+	if len(format) == 0 || bytes.Equal(format, []byte("null")) {
+		return nil, nil
+	}
+
+	if format[0] == '{' {
+		return FromJSONSchema(format)
+	}
+
+	var s string
+	if err := json.Unmarshal(format, &s); err != nil {
+		return nil, errors.New("grammar: format must be \"json\", a JSON schema or a grammar")
+	}
+
+	if s == "json" {
+		return JSON(), nil
+	}
+
+	return Parse(s)
+}
+
+type schema struct {
+	Type       json.RawMessage   `json:"type"`
+	Properties properties        `json:"properties"`
+	Required   []string          `json:"required"`
+	Items      *schema           `json:"items"`
+	Enum       []json.RawMessage `json:"enum"`
+	Const      json.RawMessage   `json:"const"`
+	AnyOf      []*schema         `json:"anyOf"`
+	OneOf      []*schema         `json:"oneOf"`
+	Ref        string            `json:"$ref"`
+}
+
+type property struct {
+	name   string
+	schema *schema
+}
+
+// properties keeps the order of an object's properties as written in the
+// schema, which is the order they are generated in.
+type properties []property
+
+func (p *properties) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return errors.New("properties must be an object")
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		var s schema
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+
+		*p = append(*p, property{name: t.(string), schema: &s})
+	}
+
+	return nil
+}
+
+// FromJSONSchema returns a grammar matching JSON values valid under schema.
+// It supports the type, properties, required, items, enum, const, anyOf and
+// oneOf keywords. Properties are generated in the order they appear in the
+// schema; if some are required, only those are always generated.
+func FromJSONSchema(b []byte) (*Grammar, error) {
+	var s schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("grammar: invalid schema: %w", err)
+	}
+
+	var c schemaConverter
+	if err := c.rule(c.name("root"), &s); err != nil {
+		return nil, err
+	}
+
+	return Parse(c.sb.String() + jsonRules)
+}
+
+type schemaConverter struct {
+	sb    strings.Builder
+	names map[string]bool
+}
+
+// name returns an unused rule name starting with base.
+func (c *schemaConverter) name(base string) string {
+	if c.names == nil {
+		c.names = make(map[string]bool)
+	}
+
+	name := base
+	for i := 1; c.names[name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+
+	c.names[name] = true
+	return name
+}
+
+// rule writes a rule called name matching values valid under s.
+func (c *schemaConverter) rule(name string, s *schema) error {
+	alts, err := c.alternatives(name, s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&c.sb, "%s ::= %s\n", name, strings.Join(alts, " | "))
+	return nil
+}
+
+func (c *schemaConverter) alternatives(name string, s *schema) ([]string, error) {
+	if s.Ref != "" {
+		return nil, fmt.Errorf("grammar: unsupported schema keyword $ref")
+	}
+
+	if len(s.Const) > 0 {
+		lit, err := jsonLiteral(s.Const)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{lit}, nil
+	}
+
+	if len(s.Enum) > 0 {
+		var alts []string
+		for _, v := range s.Enum {
+			lit, err := jsonLiteral(v)
+			if err != nil {
+				return nil, err
+			}
+
+			alts = append(alts, lit)
+		}
+
+		return alts, nil
+	}
+
+	if len(s.AnyOf) > 0 || len(s.OneOf) > 0 {
+		var alts []string
+		for i, sub := range append(s.AnyOf, s.OneOf...) {
+			subName := c.name(fmt.Sprintf("%s-%d", name, i))
+			if err := c.rule(subName, sub); err != nil {
+				return nil, err
+			}
+
+			alts = append(alts, subName)
+		}
+
+		return alts, nil
+	}
+
+	var types []string
+	if len(s.Type) > 0 {
+		var t string
+		if err := json.Unmarshal(s.Type, &t); err == nil {
+			types = []string{t}
+		} else if err := json.Unmarshal(s.Type, &types); err != nil {
+			return nil, fmt.Errorf("grammar: invalid schema type %s", s.Type)
+		}
+	}
+
+	if len(types) == 0 {
+		switch {
+		case len(s.Properties) > 0:
+			types = []string{"object"}
+		case s.Items != nil:
+			types = []string{"array"}
+		default:
+			return []string{"value"}, nil
+		}
+	}
+
+	var alts []string
+	for _, t := range types {
+		switch t {
+		case "object":
+			alt, err := c.object(name, s)
+			if err != nil {
+				return nil, err
+			}
+
+			alts = append(alts, alt)
+		case "array":
+			alt, err := c.array(name, s)
+			if err != nil {
+				return nil, err
+			}
+
+			alts = append(alts, alt)
+		case "string", "number", "integer", "boolean", "null":
+			alts = append(alts, t)
+		default:
+			return nil, fmt.Errorf("grammar: unsupported schema type %q", t)
+		}
+	}
+
+	return alts, nil
+}
+
+func (c *schemaConverter) object(name string, s *schema) (string, error) {
+	if len(s.Properties) == 0 {
+		return "object", nil
+	}
+
+	required := make(map[string]bool)
+	for _, r := range s.Required {
+		required[r] = true
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`"{" ws`)
+
+	first := true
+	for _, p := range s.Properties {
+		// without any required properties, generate all of them
+		optional := len(required) > 0 && !required[p.name]
+		if optional && first {
+			// an optional property can't lead as the comma would be wrong
+			optional = false
+		}
+
+		key, err := json.Marshal(p.name)
+		if err != nil {
+			return "", err
+		}
+
+		valueName := c.name(fmt.Sprintf("%s-%s", name, ruleName(p.name)))
+		if err := c.rule(valueName, p.schema); err != nil {
+			return "", err
+		}
+
+		member := fmt.Sprintf(`%s ws ":" ws %s`, literal(string(key)), valueName)
+		switch {
+		case first:
+			fmt.Fprintf(&sb, " %s", member)
+		case optional:
+			fmt.Fprintf(&sb, ` ( ws "," ws %s )?`, member)
+		default:
+			fmt.Fprintf(&sb, ` ws "," ws %s`, member)
+		}
+
+		first = false
+	}
+
+	sb.WriteString(` ws "}"`)
+	return "( " + sb.String() + " )", nil
+}
+
+func (c *schemaConverter) array(name string, s *schema) (string, error) {
+	if s.Items == nil {
+		return "array", nil
+	}
+
+	itemName := c.name(name + "-item")
+	if err := c.rule(itemName, s.Items); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`( "[" ws ( %[1]s ( ws "," ws %[1]s )* ws )? "]" )`, itemName), nil
+}
+
+// ruleName replaces characters that can't appear in rule names.
+func ruleName(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if isNameChar(s[i]) {
+			sb.WriteByte(s[i])
+		} else {
+			fmt.Fprintf(&sb, "_%02x", s[i])
+		}
+	}
+
+	return sb.String()
+}
+
+// jsonLiteral returns a grammar literal matching the compact encoding of v.
+func jsonLiteral(v json.RawMessage) (string, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, v); err != nil {
+		return "", err
+	}
+
+	return literal(b.String()), nil
+}
+
+// literal quotes s as a grammar string literal.
+func literal(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,198 @@
+package grammar
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrRejected = errors.New("grammar: text rejected")
+
+// position is the next element to match: element elem of alternative alt of
+// rule rule. elem may be past the end of the alternative.
+type position struct {
+	rule, alt, elem int
+}
+
+// stack is an immutable stack of positions; next holds the positions to
+// continue from once the top position's alternative is complete. A nil
+// stack has matched the whole grammar.
+type stack struct {
+	pos  position
+	next *stack
+}
+
+// Matcher tracks how much of a grammar generated text has matched so far.
+type Matcher struct {
+	g *Grammar
+
+	// stacks holds every way the text so far can continue; the top of each
+	// stack is a character class
+	stacks []*stack
+}
+
+// Matcher returns a Matcher that has matched no text.
+func (g *Grammar) Matcher() *Matcher {
+	m := Matcher{g: g}
+	for i := range g.rules[g.root] {
+		m.stacks = g.expand(&stack{pos: position{g.root, i, 0}}, m.stacks)
+	}
+
+	m.stacks = dedup(m.stacks)
+	return &m
+}
+
+// expand appends to out the stacks reachable from s without consuming
+// input, so the top of each is a character class or the stack is nil.
+func (g *Grammar) expand(s *stack, out []*stack) []*stack {
+	if s == nil {
+		return append(out, nil)
+	}
+
+	alt := g.rules[s.pos.rule][s.pos.alt]
+	if s.pos.elem >= len(alt) {
+		return g.expand(s.next, out)
+	}
+
+	e := alt[s.pos.elem]
+	if e.ref < 0 {
+		return append(out, s)
+	}
+
+	next := &stack{pos: position{s.pos.rule, s.pos.alt, s.pos.elem + 1}, next: s.next}
+	for i := range g.rules[e.ref] {
+		out = g.expand(&stack{pos: position{e.ref, i, 0}, next: next}, out)
+	}
+
+	return out
+}
+
+func (g *Grammar) element(pos position) element {
+	return g.rules[pos.rule][pos.alt][pos.elem]
+}
+
+// advance appends to out the stacks that follow s after it matches r.
+func (g *Grammar) advance(s *stack, r rune, out []*stack) []*stack {
+	if s == nil || !g.element(s.pos).matches(r) {
+		return out
+	}
+
+	return g.expand(&stack{pos: position{s.pos.rule, s.pos.alt, s.pos.elem + 1}, next: s.next}, out)
+}
+
+// match reports whether s can match all of text.
+func (g *Grammar) match(s *stack, text string) bool {
+	if text == "" {
+		return true
+	}
+
+	r, size := utf8.DecodeRuneInString(text)
+	if r == utf8.RuneError && size <= 1 {
+		return false
+	}
+
+	for _, next := range g.advance(s, r, nil) {
+		if g.match(next, text[size:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allowed reports whether text can follow the text matched so far. Text
+// that is not valid UTF-8 is never allowed.
+func (m *Matcher) Allowed(text string) bool {
+	if text == "" {
+		return true
+	}
+
+	for _, s := range m.stacks {
+		if m.g.match(s, text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Done reports whether the text matched so far is a complete match.
+func (m *Matcher) Done() bool {
+	for _, s := range m.stacks {
+		if s == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Mask reports for each token of vocab whether it can follow the text
+// matched so far. The end of sequence token eos is allowed only once the
+// grammar is complete.
+func (m *Matcher) Mask(vocab []string, eos int) []bool {
+	mask := make([]bool, len(vocab))
+	for i, text := range vocab {
+		if i == eos {
+			mask[i] = m.Done()
+		} else if text != "" {
+			mask[i] = m.Allowed(text)
+		}
+	}
+
+	return mask
+}
+
+// Accept advances the matcher past text. It returns ErrRejected, leaving
+// the matcher unchanged, if text can't follow the text matched so far.
+func (m *Matcher) Accept(text string) error {
+	stacks := m.stacks
+	for _, r := range text {
+		if r == utf8.RuneError {
+			return ErrRejected
+		}
+
+		var next []*stack
+		for _, s := range stacks {
+			next = m.g.advance(s, r, next)
+		}
+
+		if len(next) == 0 {
+			return ErrRejected
+		}
+
+		stacks = dedup(next)
+	}
+
+	m.stacks = stacks
+	return nil
+}
+
+// dedup removes stacks with the same positions so ambiguous grammars don't
+// grow the number of stacks without bound.
+func dedup(stacks []*stack) []*stack {
+	seen := make(map[string]bool, len(stacks))
+
+	var sb strings.Builder
+	j := 0
+	for _, s := range stacks {
+		sb.Reset()
+		for n := s; n != nil; n = n.next {
+			sb.WriteString(strconv.Itoa(n.pos.rule))
+			sb.WriteByte('.')
+			sb.WriteString(strconv.Itoa(n.pos.alt))
+			sb.WriteByte('.')
+			sb.WriteString(strconv.Itoa(n.pos.elem))
+			sb.WriteByte('/')
+		}
+
+		if key := sb.String(); !seen[key] {
+			seen[key] = true
+			stacks[j] = s
+			j++
+		}
+	}
+
+	return stacks[:j]
+}
@@ -21,8 +21,28 @@ struct llama_sample_options
 	int mirostat;
 	float mirostat_tau;
 	float mirostat_eta;
+	// mirostat_mu is updated by every mirostat sample
+	float mirostat_mu;
 };
 
+void llama_sample_guidance(
+		struct llama_context *ctx,
+		struct llama_token_data *candidates,
+		size_t n_candidates,
+		struct llama_context *guidance_ctx,
+		float cfg_scale)
+{
+	llama_token_data_array candidates_p = {
+		candidates,
+		n_candidates,
+		false,
+	};
+
+	llama_sample_classifier_free_guidance(
+		ctx, &candidates_p,
+		guidance_ctx, cfg_scale, 1.0f);
+}
+
 llama_token llama_sample(
 		struct llama_context *ctx,
 		struct llama_token_data *candidates,
@@ -53,19 +73,17 @@ llama_token llama_sample(
 
 	if (opts->mirostat == 1) {
 		int mirostat_m = 100;
-		float mirostat_mu = 2.0f * opts->mirostat_tau;
 		llama_sample_temperature(ctx, &candidates_p, opts->temperature);
 		return llama_sample_token_mirostat(
 			ctx, &candidates_p,
 			opts->mirostat_tau, opts->mirostat_eta,
-			mirostat_m, &mirostat_mu);
+			mirostat_m, &opts->mirostat_mu);
 	} else if (opts->mirostat == 2) {
-		float mirostat_mu = 2.0f * opts->mirostat_tau;
 		llama_sample_temperature(ctx, &candidates_p, opts->temperature);
 		return llama_sample_token_mirostat_v2(
 			ctx, &candidates_p,
 			opts->mirostat_tau, opts->mirostat_eta,
-			&mirostat_mu);
+			&opts->mirostat_mu);
 	} else {
 		llama_sample_top_k(ctx, &candidates_p, opts->top_k, 1);
 		llama_sample_tail_free(ctx, &candidates_p, opts->tfs_z, 1);
@@ -79,32 +97,62 @@ llama_token llama_sample(
 import "C"
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 	"unsafe"
 
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/grammar"
 )
 
-type llama struct {
+type LLM struct {
 	params *C.struct_llama_context_params
 	model  *C.struct_llama_model
 	ctx    *C.struct_llama_context
 
+	// guidance is a second context for classifier-free guidance, created
+	// the first time a request sets a negative prompt
+	guidance *C.struct_llama_context
+
+	// embd holds the tokens in the kv cache
+	embd []C.llama_token
+	// next holds the tokens that follow embd in the last conversation but
+	// weren't evaluated, such as the final token of a response
+	next []C.llama_token
+	// states holds the kv caches of other conversations, least recently
+	// used first
+	states []*state
+
+	// vocab holds the text of each token, read the first time a request is
+	// constrained by a grammar
+	vocab []string
+
 	api.Options
 }
 
-func New(model string, opts api.Options) (*llama, error) {
+// New loads model and applies each of adapters, which are LoRA adapters
+// fine-tuned from it, in order.
+func New(model string, adapters []string, opts api.Options) (*LLM, error) {
 	if _, err := os.Stat(model); err != nil {
 		return nil, err
 	}
 
-	llm := llama{Options: opts}
+	if len(adapters) > 0 {
+		// adapters modify the weights in place, which a read-only mapping
+		// doesn't allow
+		opts.UseMMap = false
+	}
+
+	llm := LLM{Options: opts}
 
 	C.llama_backend_init(C.bool(llm.UseNUMA))
 
@@ -131,52 +179,252 @@ func New(model string, opts api.Options) (*llama, error) {
 		return nil, errors.New("failed to load model")
 	}
 
+	for _, adapter := range adapters {
+		cAdapter := C.CString(adapter)
+		defer C.free(unsafe.Pointer(cAdapter))
+
+		if rc := C.llama_model_apply_lora_from_file(llm.model, cAdapter, nil, C.int(llm.NumThread)); rc != 0 {
+			C.llama_free_model(llm.model)
+			return nil, fmt.Errorf("llama: failed to apply adapter %s", adapter)
+		}
+	}
+
 	llm.ctx = C.llama_new_context_with_model(llm.model, params)
 	if llm.ctx == nil {
 		return nil, errors.New("failed to create context")
 	}
 
-	// warm up the model
-	bos := []C.llama_token{C.llama_token_bos()}
-	C.llama_eval(llm.ctx, unsafe.SliceData(bos), C.int(len(bos)), 0, C.int(opts.NumThread))
-	C.llama_reset_timings(llm.ctx)
+	if !llm.VocabOnly {
+		// warm up the model
+		bos := []C.llama_token{C.llama_token_bos()}
+		C.llama_eval(llm.ctx, unsafe.SliceData(bos), C.int(len(bos)), 0, C.int(opts.NumThread))
+		C.llama_reset_timings(llm.ctx)
+		llm.embd = bos
+	}
 
 	return &llm, nil
 }
 
-func (llm *llama) Close() {
+// SetOptions replaces the predict options of a loaded model. Load options
+// such as NumCtx or UseMMap only take effect when the model is created.
+func (llm *LLM) SetOptions(opts api.Options) {
+	llm.Options = opts
+}
+
+func (llm *LLM) Close() {
 	defer C.llama_free_model(llm.model)
 	defer C.llama_free(llm.ctx)
+	defer llm.freeStates()
+
+	if llm.guidance != nil {
+		defer C.llama_free(llm.guidance)
+	}
 
 	C.llama_print_timings(llm.ctx)
 }
 
-func (llm *llama) Predict(ctx []int, prompt string, fn func(api.GenerateResponse)) error {
-	if input := llm.tokenize(prompt); input != nil {
-		embd := make([]C.llama_token, len(ctx))
-		for i := range ctx {
-			embd[i] = C.llama_token(ctx[i])
+// Predict generates a response to prompt, continuing from the tokens in
+// prevContext. If g is not nil, only text matching g is generated.
+// Generation stops early if ctx is cancelled, in which case the final
+// response is still sent to fn and ctx.Err() is returned.
+func (llm *LLM) Predict(ctx context.Context, prevContext []int, prompt string, g *grammar.Grammar, fn func(api.GenerateResponse)) error {
+	if input := llm.tokenize(prompt, true); input != nil {
+		embd := make([]C.llama_token, len(prevContext))
+		for i := range prevContext {
+			embd[i] = C.llama_token(prevContext[i])
+		}
+
+		embd = append(embd, input...)
+		if len(embd) >= llm.NumCtx {
+			if !llm.ContextShift {
+				return fmt.Errorf("llama: prompt is %d tokens, exceeding the context size of %d", len(embd), llm.NumCtx)
+			}
+
+			// keep the start of the prompt and enough of its end to fill half
+			// of the context window, leaving the rest for the response
+			numKeep := llm.numKeep()
+			numTail := (llm.NumCtx - numKeep) / 2
+			embd = append(embd[:numKeep:numKeep], embd[len(embd)-numTail:]...)
 		}
 
-		return llm.generate(append(embd, input...), fn)
+		return llm.generate(ctx, embd, g, fn)
 	}
 
 	return errors.New("llama: tokenize")
 }
 
-func (llm *llama) tokenize(prompt string) []C.llama_token {
+// Tokenize returns the tokens of prompt, including the leading
+// beginning-of-sentence token.
+func (llm *LLM) Tokenize(prompt string) ([]int, error) {
+	tokens := llm.tokenize(prompt, true)
+	if tokens == nil {
+		// llama_tokenize returns nothing for empty text
+		tokens = []C.llama_token{C.llama_token_bos()}
+	}
+
+	ids := make([]int, len(tokens))
+	for i := range tokens {
+		ids[i] = int(tokens[i])
+	}
+
+	return ids, nil
+}
+
+// Detokenize returns the text of tokens.
+func (llm *LLM) Detokenize(tokens []int) (string, error) {
+	numVocab := int(C.llama_n_vocab(llm.ctx))
+
+	ids := make([]C.llama_token, len(tokens))
+	for i := range tokens {
+		if tokens[i] < 0 || tokens[i] >= numVocab {
+			return "", fmt.Errorf("llama: invalid token %d", tokens[i])
+		}
+
+		ids[i] = C.llama_token(tokens[i])
+	}
+
+	return llm.detokenize(ids...), nil
+}
+
+// Vocab returns the model's vocabulary ordered by token id.
+func (llm *LLM) Vocab() []api.VocabEntry {
+	numVocab := int(C.llama_n_vocab(llm.ctx))
+	strs := make([]*C.char, numVocab)
+	scores := make([]C.float, numVocab)
+
+	n := int(C.llama_get_vocab(llm.ctx, unsafe.SliceData(strs), unsafe.SliceData(scores), C.int(numVocab)))
+
+	vocab := make([]api.VocabEntry, n)
+	for i := range vocab {
+		vocab[i] = api.VocabEntry{
+			ID:    i,
+			Text:  C.GoString(strs[i]),
+			Score: float32(scores[i]),
+		}
+	}
+
+	return vocab
+}
+
+// Embedding evaluates input and returns the embedding of its last token. The
+// model must be loaded with EmbeddingOnly.
+func (llm *LLM) Embedding(input string) ([]float64, error) {
+	if !llm.EmbeddingOnly {
+		return nil, errors.New("llama: embedding not enabled")
+	}
+
+	tokens := llm.tokenize(input, true)
+	if tokens == nil {
+		return nil, errors.New("llama: tokenize")
+	}
+
+	if len(tokens) > llm.NumCtx {
+		return nil, fmt.Errorf("llama: input is %d tokens, exceeding the context size of %d", len(tokens), llm.NumCtx)
+	}
+
+	llm.embd, llm.next = nil, nil
+	if err := llm.eval(tokens, 0); err != nil {
+		return nil, err
+	}
+
+	llm.embd = tokens
+
+	numEmbd := int(C.llama_n_embd(llm.ctx))
+	embeddings := unsafe.Slice(C.llama_get_embeddings(llm.ctx), numEmbd)
+
+	embedding := make([]float64, numEmbd)
+	for i := range embeddings {
+		embedding[i] = float64(embeddings[i])
+	}
+
+	return embedding, nil
+}
+
+// Score returns the log likelihood of each candidate continuing prompt. The
+// model must be loaded with LogitsAll.
+func (llm *LLM) Score(prompt string, candidates []string) ([]api.Score, error) {
+	if !llm.LogitsAll {
+		return nil, errors.New("llama: logits_all not enabled")
+	}
+
+	input := llm.tokenize(prompt, true)
+	if input == nil {
+		return nil, errors.New("llama: tokenize")
+	}
+
+	numVocab := int(C.llama_n_vocab(llm.ctx))
+
+	scores := make([]api.Score, len(candidates))
+	for i, candidate := range candidates {
+		scores[i].Candidate = candidate
+
+		tokens := llm.tokenize(candidate, false)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		embd := append(append(make([]C.llama_token, 0, len(input)+len(tokens)), input...), tokens...)
+		if len(embd) > llm.NumCtx {
+			return nil, fmt.Errorf("llama: prompt and candidate are %d tokens, exceeding the context size of %d", len(embd), llm.NumCtx)
+		}
+
+		// the logits after a token predict the token that follows it, so
+		// those of the last token of the prompt and every token of the
+		// candidate but the last are kept. Each eval only returns the
+		// logits of its own batch.
+		first := len(input) - 1
+		logits := make([]C.float, len(tokens)*numVocab)
+
+		llm.embd, llm.next = nil, nil
+		if err := llm.evalContext(llm.ctx, embd, 0, func(i, n int) {
+			batch := unsafe.Slice(C.llama_get_logits(llm.ctx), n*numVocab)
+			for pos := i; pos < i+n && pos < len(embd)-1; pos++ {
+				if pos >= first {
+					row := batch[(pos-i)*numVocab : (pos-i+1)*numVocab]
+					copy(logits[(pos-first)*numVocab:], row)
+				}
+			}
+		}); err != nil {
+			return nil, err
+		}
+
+		llm.embd = embd
+
+		for j, token := range tokens {
+			logprobs := logSoftmax(logits[j*numVocab : (j+1)*numVocab])
+
+			scores[i].Logprob += float64(logprobs[token])
+			scores[i].Tokens = append(scores[i].Tokens, api.Logprob{
+				ID:      int(token),
+				Text:    llm.detokenize(token),
+				Logprob: logprobs[token],
+			})
+		}
+	}
+
+	return scores, nil
+}
+
+func (llm *LLM) tokenize(prompt string, addBOS bool) []C.llama_token {
 	cPrompt := C.CString(prompt)
 	defer C.free(unsafe.Pointer(cPrompt))
 
-	tokens := make([]C.llama_token, llm.NumCtx)
-	if n := C.llama_tokenize(llm.ctx, cPrompt, unsafe.SliceData(tokens), C.int(len(tokens)), true); n > 0 {
+	tokens := make([]C.llama_token, len(prompt)+2)
+	n := C.llama_tokenize(llm.ctx, cPrompt, unsafe.SliceData(tokens), C.int(len(tokens)), C.bool(addBOS))
+	if n < 0 {
+		// the buffer was too small, -n is the number of tokens required
+		tokens = make([]C.llama_token, -n)
+		n = C.llama_tokenize(llm.ctx, cPrompt, unsafe.SliceData(tokens), C.int(len(tokens)), C.bool(addBOS))
+	}
+
+	if n > 0 {
 		return tokens[:n]
 	}
 
 	return nil
 }
 
-func (llm *llama) detokenize(tokens ...C.llama_token) string {
+func (llm *LLM) detokenize(tokens ...C.llama_token) string {
 	var sb strings.Builder
 	for _, token := range tokens {
 		sb.WriteString(C.GoString(C.llama_token_to_str(llm.ctx, token)))
@@ -185,81 +433,462 @@ func (llm *llama) detokenize(tokens ...C.llama_token) string {
 	return sb.String()
 }
 
-func (llm *llama) generate(input []C.llama_token, fn func(api.GenerateResponse)) error {
-	var opts C.struct_llama_sample_options
-	opts.repeat_penalty = C.float(llm.RepeatPenalty)
-	opts.frequency_penalty = C.float(llm.FrequencyPenalty)
-	opts.presence_penalty = C.float(llm.PresencePenalty)
-	opts.temperature = C.float(llm.Temperature)
-	opts.top_k = C.int(llm.TopK)
-	opts.top_p = C.float(llm.TopP)
-	opts.tfs_z = C.float(llm.TFSZ)
-	opts.typical_p = C.float(llm.TypicalP)
-	opts.mirostat = C.int(llm.Mirostat)
-	opts.mirostat_tau = C.float(llm.MirostatTau)
-	opts.mirostat_eta = C.float(llm.MirostatEta)
-
-	output := deque[C.llama_token]{capacity: llm.NumCtx}
-
-	context := deque[int]{capacity: llm.NumCtx / 2}
-	for _, in := range input {
-		context.PushLeft(int(in))
-	}
-
-	var b bytes.Buffer
-	for C.llama_get_kv_cache_token_count(llm.ctx) < C.int(llm.NumCtx) {
-		if retval := C.llama_eval(llm.ctx, unsafe.SliceData(input), C.int(len(input)), C.llama_get_kv_cache_token_count(llm.ctx), C.int(llm.NumThread)); retval != 0 {
-			return errors.New("llama: eval")
+func (llm *LLM) generate(ctx context.Context, input []C.llama_token, g *grammar.Grammar, fn func(api.GenerateResponse)) error {
+	bias, err := llm.logitBias()
+	if err != nil {
+		return err
+	}
+
+	// the guidance context evaluates the negative prompt in place of input
+	// followed by the same generated tokens
+	var guidanceHistory, guidanceInput []C.llama_token
+	if llm.NegativePrompt != "" && llm.CFGScale > 0 && llm.CFGScale != 1 {
+		if llm.guidance == nil {
+			llm.guidance = C.llama_new_context_with_model(llm.model, *llm.params)
+			if llm.guidance == nil {
+				return errors.New("llama: failed to create guidance context")
+			}
 		}
 
-		token, err := llm.sample(output, &opts)
-		if errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
-			return err
+		guidanceInput = llm.tokenize(llm.NegativePrompt, true)
+		if guidanceInput == nil {
+			return errors.New("llama: tokenize")
+		} else if len(guidanceInput) >= llm.NumCtx {
+			return fmt.Errorf("llama: negative prompt is %d tokens, exceeding the context size of %d", len(guidanceInput), llm.NumCtx)
 		}
 
-		b.WriteString(llm.detokenize(token))
-		if utf8.Valid(b.Bytes()) || b.Len() >= utf8.UTFMax {
-			// call the callback
-			fn(api.GenerateResponse{
-				Response: b.String(),
-			})
+		guidanceHistory = make([]C.llama_token, 0, llm.NumCtx)
+	}
+
+	useGuidance := guidanceInput != nil
+
+	// only report timings for this request
+	C.llama_reset_timings(llm.ctx)
+
+	prompt := input
+
+	// skip the part of input already in the kv cache from a previous request
+	numPast := llm.prepare(input)
+	history := append(make([]C.llama_token, 0, llm.NumCtx), input[:numPast]...)
+	input = input[numPast:]
+	defer func() {
+		llm.embd, llm.next = history, input
+	}()
+
+	numCompletions := llm.N
+	if numCompletions < 1 {
+		numCompletions = 1
+	}
+
+	// with several completions, the state after evaluating the prompt is
+	// copied so each completion after the first starts from it
+	var promptHistory, promptGuidanceHistory []C.llama_token
+	var promptState, promptGuidanceState *state
+	defer func() {
+		if promptState != nil {
+			promptState.free()
+		}
+
+		if promptGuidanceState != nil {
+			promptGuidanceState.free()
+		}
+	}()
+
+	for index := 0; index < numCompletions; index++ {
+		if index > 0 {
+			promptState.restore(llm.ctx)
+			history = append(history[:0], promptHistory...)
+			input = nil
+
+			if useGuidance {
+				promptGuidanceState.restore(llm.guidance)
+				guidanceHistory = append(guidanceHistory[:0], promptGuidanceHistory...)
+				guidanceInput = nil
+			}
+
+			C.llama_reset_timings(llm.ctx)
+		}
+
+		// seed each completion so the same request reproduces its output,
+		// whatever the model generated before. The state copied for later
+		// completions includes the random number generator, which would
+		// otherwise produce the same completion again.
+		if llm.Seed >= 0 {
+			C.llama_set_rng_seed(llm.ctx, C.uint32_t(llm.Seed+index))
+		} else if index > 0 {
+			C.llama_set_rng_seed(llm.ctx, C.uint32_t(rand.Uint32()))
+		}
+
+		sampler := llm.newSampler(bias, g)
+		if useGuidance {
+			sampler.guidance = llm.guidance
+			sampler.cfgScale = C.float(llm.CFGScale)
+		}
+
+		context := deque[int]{capacity: llm.NumCtx / 2}
+		for _, in := range prompt {
+			context.PushLeft(int(in))
+		}
+
+		// pending holds output that may be the start of a stop sequence and
+		// pendingTokens the log probabilities of the tokens not yet sent.
+		// Each is sent with the response that completes its token's text,
+		// which ends at pendingEnds in the output, and any left over are
+		// sent with the final response.
+		var pending string
+		var pendingTokens []api.TokenLogprob
+		var pendingEnds []int
+		var numOutput, numEmitted int
+		emit := func(s string) {
+			if s == "" {
+				return
+			}
+
+			numEmitted += len(s)
+
+			var n int
+			for n < len(pendingEnds) && pendingEnds[n] <= numEmitted {
+				n++
+			}
+
+			var tokens []api.TokenLogprob
+			if n > 0 {
+				tokens = pendingTokens[:n:n]
+				pendingTokens, pendingEnds = pendingTokens[n:], pendingEnds[n:]
+			}
+
+			fn(api.GenerateResponse{Index: index, Response: s, Tokens: tokens})
+		}
 
-			output.PushLeft(token)
+		var b bytes.Buffer
+		var numPredicted int
+		var doneReason string
+		for {
+			if ctx.Err() != nil {
+				doneReason = api.DoneReasonCancelled
+				break
+			}
+
+			if len(history)+len(input) > llm.NumCtx {
+				if !llm.ContextShift {
+					doneReason = api.DoneReasonContextFull
+					break
+				}
+
+				input = llm.shift(&history, input)
+			}
+
+			if err = llm.eval(input, len(history)); err != nil {
+				doneReason = api.DoneReasonError
+				break
+			}
+
+			history = append(history, input...)
+			input = nil
+
+			if useGuidance {
+				if len(guidanceHistory)+len(guidanceInput) > llm.NumCtx {
+					guidanceInput = llm.shift(&guidanceHistory, guidanceInput)
+				}
+
+				if err = llm.evalContext(llm.guidance, guidanceInput, len(guidanceHistory), nil); err != nil {
+					doneReason = api.DoneReasonError
+					break
+				}
+
+				guidanceHistory = append(guidanceHistory, guidanceInput...)
+			}
+
+			if numCompletions > 1 && promptState == nil {
+				promptState = copyState(llm.ctx)
+				promptHistory = append([]C.llama_token(nil), history...)
+				if useGuidance {
+					promptGuidanceState = copyState(llm.guidance)
+					promptGuidanceHistory = append([]C.llama_token(nil), guidanceHistory...)
+				}
+			}
+
+			var token C.llama_token
+			var logprob *api.TokenLogprob
+			token, logprob, err = llm.sample(sampler)
+			if errors.Is(err, io.EOF) {
+				doneReason = api.DoneReasonStop
+				err = nil
+				break
+			} else if err != nil {
+				doneReason = api.DoneReasonError
+				break
+			}
+
+			text := llm.detokenize(token)
+			if err = sampler.accept(token, text); err != nil {
+				doneReason = api.DoneReasonError
+				break
+			}
+
+			// the token is evaluated on the next iteration, or left in input
+			// if generation stops first
+			input = []C.llama_token{token}
+			guidanceInput = []C.llama_token{token}
 			context.PushLeft(int(token))
-			b.Reset()
+
+			numOutput += len(text)
+			if logprob != nil {
+				pendingTokens = append(pendingTokens, *logprob)
+				pendingEnds = append(pendingEnds, numOutput)
+			}
+
+			b.WriteString(text)
+			if utf8.Valid(b.Bytes()) || b.Len() >= utf8.UTFMax {
+				pending += b.String()
+				b.Reset()
+
+				if i := stopIndex(pending, llm.Stop); i >= 0 {
+					emit(pending[:i])
+					pending = ""
+					doneReason = api.DoneReasonStop
+					break
+				}
+
+				// hold back any suffix that could still become a stop sequence
+				n := len(pending) - partialStopLen(pending, llm.Stop)
+				emit(pending[:n])
+				pending = pending[n:]
+			}
+
+			numPredicted++
+			if llm.NumPredict > 0 && numPredicted >= llm.NumPredict {
+				doneReason = api.DoneReasonLength
+				break
+			}
+		}
+
+		emit(pending)
+
+		dur := func(ms float64) time.Duration {
+			d, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
+			if err != nil {
+				panic(err)
+			}
+
+			return d
+		}
+
+		timings := C.llama_get_timings(llm.ctx)
+		fn(api.GenerateResponse{
+			Index:              index,
+			Done:               true,
+			DoneReason:         doneReason,
+			Tokens:             pendingTokens,
+			Context:            context.Data(),
+			PromptEvalCount:    int(timings.n_p_eval),
+			PromptEvalDuration: dur(float64(timings.t_p_eval_ms)),
+			EvalCount:          int(timings.n_eval),
+			EvalDuration:       dur(float64(timings.t_eval_ms)),
+		})
+
+		if err != nil || ctx.Err() != nil || promptState == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// eval evaluates tokens in batches of NumBatch after the first numPast
+// tokens of the kv cache.
+func (llm *LLM) eval(tokens []C.llama_token, numPast int) error {
+	return llm.evalContext(llm.ctx, tokens, numPast, nil)
+}
+
+// evalContext evaluates tokens in batches of NumBatch. If fn is not nil, it
+// is called after each batch with the batch's offset in tokens and length,
+// while the logits of the batch are available.
+func (llm *LLM) evalContext(ctx *C.struct_llama_context, tokens []C.llama_token, numPast int, fn func(i, n int)) error {
+	batch := llm.NumBatch
+	if batch <= 0 {
+		batch = len(tokens)
+	}
+
+	for i := 0; i < len(tokens); i += batch {
+		n := len(tokens) - i
+		if n > batch {
+			n = batch
+		}
+
+		if retval := C.llama_eval(ctx, &tokens[i], C.int(n), C.int(numPast+i), C.int(llm.NumThread)); retval != 0 {
+			return errors.New("llama: eval")
 		}
 
-		input = []C.llama_token{token}
+		if fn != nil {
+			fn(i, n)
+		}
+	}
+
+	return nil
+}
+
+// numKeep returns the number of tokens at the start of the context that are
+// kept when the context window shifts. The beginning of sentence token is
+// always kept.
+func (llm *LLM) numKeep() int {
+	numKeep := llm.NumKeep
+	if numKeep < 1 {
+		numKeep = 1
+	}
+
+	if numKeep > llm.NumCtx/2 {
+		numKeep = llm.NumCtx / 2
 	}
 
-	dur := func(ms float64) time.Duration {
-		d, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
-		if err != nil {
-			panic(err)
+	return numKeep
+}
+
+// shift makes room in a full context window by discarding the older half of
+// the tokens in history after the first numKeep. The kept tokens have to be
+// evaluated again at their new positions so they are returned ahead of input.
+func (llm *LLM) shift(history *[]C.llama_token, input []C.llama_token) []C.llama_token {
+	numKeep := llm.numKeep()
+	if numKeep > len(*history) {
+		numKeep = len(*history)
+	}
+
+	numDiscard := (len(*history) - numKeep) / 2
+	kept := (*history)[numKeep+numDiscard:]
+
+	shifted := make([]C.llama_token, 0, len(kept)+len(input))
+	shifted = append(shifted, kept...)
+	shifted = append(shifted, input...)
+
+	*history = (*history)[:numKeep]
+	return shifted
+}
+
+// logitBias resolves the keys of LogitBias to tokens. A key is either a
+// token id or text, in which case the bias applies to every token of the
+// text.
+func (llm *LLM) logitBias() (map[C.llama_token]float32, error) {
+	if len(llm.LogitBias) == 0 {
+		return nil, nil
+	}
+
+	numVocab := int(C.llama_n_vocab(llm.ctx))
+
+	bias := make(map[C.llama_token]float32)
+	for key, value := range llm.LogitBias {
+		if id, err := strconv.Atoi(key); err == nil {
+			if id < 0 || id >= numVocab {
+				return nil, fmt.Errorf("llama: invalid token %d in logit bias", id)
+			}
+
+			bias[C.llama_token(id)] += value
+			continue
+		}
+
+		tokens := llm.tokenize(key, false)
+		if tokens == nil {
+			return nil, fmt.Errorf("llama: couldn't tokenize %q in logit bias", key)
 		}
 
-		return d
+		for _, token := range tokens {
+			bias[token] += value
+		}
 	}
 
-	timings := C.llama_get_timings(llm.ctx)
-	fn(api.GenerateResponse{
-		Done:               true,
-		Context:            context.Data(),
-		PromptEvalCount:    int(timings.n_p_eval),
-		PromptEvalDuration: dur(float64(timings.t_p_eval_ms)),
-		EvalCount:          int(timings.n_eval),
-		EvalDuration:       dur(float64(timings.t_eval_ms)),
-	})
+	return bias, nil
+}
 
+// tokenTexts returns the text of every token, indexed by token id.
+func (llm *LLM) tokenTexts() []string {
+	if llm.vocab == nil {
+		numVocab := int(C.llama_n_vocab(llm.ctx))
+		llm.vocab = make([]string, numVocab)
+		for i := range llm.vocab {
+			llm.vocab[i] = llm.detokenize(C.llama_token(i))
+		}
+	}
+
+	return llm.vocab
+}
+
+// sampler holds the state of sampling a completion, which carries over from
+// one token to the next.
+type sampler struct {
+	opts    C.struct_llama_sample_options
+	bias    map[C.llama_token]float32
+	matcher *grammar.Matcher
+
+	// guidance is the context of the negative prompt, if any
+	guidance *C.struct_llama_context
+	cfgScale C.float
+
+	// last holds the tokens sampled so far for the repetition penalties
+	last deque[C.llama_token]
+}
+
+func (llm *LLM) newSampler(bias map[C.llama_token]float32, g *grammar.Grammar) *sampler {
+	s := sampler{
+		bias: bias,
+		last: deque[C.llama_token]{capacity: llm.NumCtx},
+	}
+
+	if g != nil {
+		s.matcher = g.Matcher()
+	}
+
+	s.opts.repeat_penalty = C.float(llm.RepeatPenalty)
+	s.opts.frequency_penalty = C.float(llm.FrequencyPenalty)
+	s.opts.presence_penalty = C.float(llm.PresencePenalty)
+	s.opts.temperature = C.float(llm.Temperature)
+	s.opts.top_k = C.int(llm.TopK)
+	s.opts.top_p = C.float(llm.TopP)
+	s.opts.tfs_z = C.float(llm.TFSZ)
+	s.opts.typical_p = C.float(llm.TypicalP)
+	s.opts.mirostat = C.int(llm.Mirostat)
+	s.opts.mirostat_tau = C.float(llm.MirostatTau)
+	s.opts.mirostat_eta = C.float(llm.MirostatEta)
+	s.opts.mirostat_mu = C.float(2 * llm.MirostatTau)
+	return &s
+}
+
+// accept records that token, whose text is text, was sampled.
+func (s *sampler) accept(token C.llama_token, text string) error {
+	if s.matcher != nil {
+		if err := s.matcher.Accept(text); err != nil {
+			return err
+		}
+	}
+
+	s.last.PushLeft(token)
 	return nil
 }
 
-func (llm *llama) sample(output deque[C.llama_token], opts *C.struct_llama_sample_options) (C.llama_token, error) {
+// sample picks the next token. If Logprobs or TopLogprobs is set, it also
+// returns the token's log probability and the most likely alternatives.
+func (llm *LLM) sample(s *sampler) (C.llama_token, *api.TokenLogprob, error) {
 	numVocab := int(C.llama_n_vocab(llm.ctx))
 	logits := unsafe.Slice(C.llama_get_logits(llm.ctx), numVocab)
 
+	// tokens that can't continue the grammar are never sampled
+	var mask []bool
+	if s.matcher != nil {
+		mask = s.matcher.Mask(llm.tokenTexts(), int(C.llama_token_eos()))
+		mask[C.llama_token_bos()] = false
+
+		var allowed bool
+		for _, ok := range mask {
+			allowed = allowed || ok
+		}
+
+		if !allowed {
+			return 0, nil, errors.New("llama: no token matches the grammar")
+		}
+	}
+
 	candidates := deque[C.struct_llama_token_data]{capacity: numVocab}
 	for i := 0; i < candidates.Cap(); i++ {
 		candidates.PushLeft(C.struct_llama_token_data{
@@ -269,14 +898,110 @@ func (llm *llama) sample(output deque[C.llama_token], opts *C.struct_llama_sampl
 		})
 	}
 
+	data := candidates.Data()
+
+	// guidance compares the model's own logits with those of the negative
+	// prompt, so it comes before the bias and the grammar change them
+	if s.guidance != nil {
+		C.llama_sample_guidance(llm.ctx, unsafe.SliceData(data), C.size_t(len(data)), s.guidance, s.cfgScale)
+	}
+
+	for i := range data {
+		data[i].logit += C.float(s.bias[C.llama_token(i)])
+		if mask != nil && !mask[i] {
+			data[i].logit = C.float(math.Inf(-1))
+		}
+	}
+
+	// log probabilities come from the final logits, before sampling
+	// reshapes them
+	var logprobs []float32
+	if llm.Logprobs || llm.TopLogprobs > 0 {
+		adjusted := make([]C.float, len(data))
+		for i := range data {
+			adjusted[i] = data[i].logit
+		}
+
+		logprobs = logSoftmax(adjusted)
+	}
+
 	token := C.llama_sample(
 		llm.ctx,
-		unsafe.SliceData(candidates.Data()), C.size_t(candidates.Len()),
-		unsafe.SliceData(output.Data()), C.size_t(output.Len()),
-		opts)
-	if token != C.llama_token_eos() {
-		return token, nil
+		unsafe.SliceData(data), C.size_t(len(data)),
+		unsafe.SliceData(s.last.Data()), C.size_t(s.last.Len()),
+		&s.opts)
+	if token == C.llama_token_eos() {
+		return 0, nil, io.EOF
+	}
+
+	if logprobs == nil {
+		return token, nil, nil
+	}
+
+	logprob := api.TokenLogprob{
+		Logprob: api.Logprob{
+			ID:      int(token),
+			Text:    llm.detokenize(token),
+			Logprob: logprobs[token],
+		},
+	}
+
+	for _, id := range topLogprobs(logprobs, llm.TopLogprobs) {
+		logprob.TopLogprobs = append(logprob.TopLogprobs, api.Logprob{
+			ID:      id,
+			Text:    llm.detokenize(C.llama_token(id)),
+			Logprob: logprobs[id],
+		})
+	}
+
+	return token, &logprob, nil
+}
+
+// logSoftmax returns the log probability of each token given its logit.
+func logSoftmax(logits []C.float) []float32 {
+	maxLogit := math.Inf(-1)
+	for _, logit := range logits {
+		maxLogit = math.Max(maxLogit, float64(logit))
+	}
+
+	var sum float64
+	for _, logit := range logits {
+		sum += math.Exp(float64(logit) - maxLogit)
+	}
+
+	logprobs := make([]float32, len(logits))
+	for i, logit := range logits {
+		logprobs[i] = float32(float64(logit) - maxLogit - math.Log(sum))
+	}
+
+	return logprobs
+}
+
+// topLogprobs returns the ids of the n most likely tokens, most likely
+// first. Tokens that can't be sampled are left out.
+func topLogprobs(logprobs []float32, n int) []int {
+	var top []int
+	for id, logprob := range logprobs {
+		if math.IsInf(float64(logprob), -1) {
+			continue
+		}
+
+		i := len(top)
+		for i > 0 && logprobs[top[i-1]] < logprob {
+			i--
+		}
+
+		if i >= n {
+			continue
+		}
+
+		top = append(top, 0)
+		copy(top[i+1:], top[i:])
+		top[i] = id
+		if len(top) > n {
+			top = top[:n]
+		}
 	}
 
-	return 0, io.EOF
+	return top
 }
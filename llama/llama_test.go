@@ -0,0 +1,755 @@
+package llama
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// writeTestModel writes a tiny llama model with random weights in the ggjt
+// format. Its output is gibberish, but it is generated like a real model's.
+func writeTestModel(t *testing.T) string {
+	t.Helper()
+
+	const (
+		numEmbd  = 32
+		numMult  = 32
+		numHead  = 4
+		numLayer = 2
+		numRot   = numEmbd / numHead
+		numFF    = ((2*(4*numEmbd)/3 + numMult - 1) / numMult) * numMult
+	)
+
+	// unknown, beginning and end of sentence, then every byte and some words
+	vocab := []string{"<unk>", "<s>", "</s>"}
+	for i := 0; i < 256; i++ {
+		vocab = append(vocab, string([]byte{byte(i)}))
+	}
+
+	vocab = append(vocab, " hello", " world", " the", " a", " cat", " dog", " is", "ing")
+
+	var b bytes.Buffer
+	write := func(vs ...any) {
+		for _, v := range vs {
+			if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// magic "ggjt", version 3
+	write(uint32(0x67676a74), uint32(3))
+	write(uint32(len(vocab)), uint32(numEmbd), uint32(numMult), uint32(numHead), uint32(numLayer), uint32(numRot), uint32(0))
+	for i, text := range vocab {
+		write(uint32(len(text)), []byte(text), float32(-i))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	tensor := func(name string, ne ...uint32) {
+		write(uint32(len(ne)), uint32(len(name)), uint32(0))
+		write(ne, []byte(name))
+
+		// tensor data is aligned to 32 bytes
+		b.Write(make([]byte, -b.Len()&31))
+
+		n := 1
+		for _, d := range ne {
+			n *= int(d)
+		}
+
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = float32(r.NormFloat64())
+		}
+
+		write(data)
+	}
+
+	norm := func(name string) {
+		write(uint32(1), uint32(len(name)), uint32(0))
+		write(uint32(numEmbd), []byte(name))
+		b.Write(make([]byte, -b.Len()&31))
+
+		data := make([]float32, numEmbd)
+		for i := range data {
+			data[i] = 1
+		}
+
+		write(data)
+	}
+
+	tensor("tok_embeddings.weight", numEmbd, uint32(len(vocab)))
+	norm("norm.weight")
+	tensor("output.weight", numEmbd, uint32(len(vocab)))
+	for i := 0; i < numLayer; i++ {
+		prefix := fmt.Sprintf("layers.%d.", i)
+		norm(prefix + "attention_norm.weight")
+		for _, w := range []string{"wq", "wk", "wv", "wo"} {
+			tensor(prefix+"attention."+w+".weight", numEmbd, numEmbd)
+		}
+
+		norm(prefix + "ffn_norm.weight")
+		tensor(prefix+"feed_forward.w1.weight", numEmbd, numFF)
+		tensor(prefix+"feed_forward.w2.weight", numFF, numEmbd)
+		tensor(prefix+"feed_forward.w3.weight", numEmbd, numFF)
+	}
+
+	path := filepath.Join(t.TempDir(), "model.bin")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func predict(t *testing.T, llm *LLM, prompt string) string {
+	t.Helper()
+
+	var response []byte
+	if err := llm.Predict(context.Background(), nil, prompt, nil, func(r api.GenerateResponse) {
+		response = append(response, r.Response...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return string(response)
+}
+
+func TestPredictSeed(t *testing.T) {
+	model := writeTestModel(t)
+
+	for _, mirostat := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("mirostat=%d", mirostat), func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumCtx = 128
+			opts.NumPredict = 32
+			opts.NumThread = 1
+			opts.Mirostat = mirostat
+			opts.Seed = 42
+
+			llm, err := New(model, nil, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer llm.Close()
+
+			want := predict(t, llm, " hello world")
+			if want == "" {
+				t.Fatal("expected a response")
+			}
+
+			// the second request reuses the kv cache of the first, and the
+			// last one restores it after another prompt replaced it
+			for _, prompt := range []string{" hello world", " the cat is", " hello world"} {
+				got := predict(t, llm, prompt)
+				if prompt == " hello world" && got != want {
+					t.Errorf("expected %q, got %q", want, got)
+				}
+			}
+
+			// a freshly loaded model gives the same response
+			other, err := New(model, nil, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+
+			if got := predict(t, other, " hello world"); got != want {
+				t.Errorf("expected %q from a new model, got %q", want, got)
+			}
+
+			opts.Seed = 7
+			llm.SetOptions(opts)
+			if got := predict(t, llm, " hello world"); got == want {
+				t.Errorf("expected a different response with another seed, got %q", got)
+			}
+		})
+	}
+}
+
+// TestPredictLogprobs checks that log probabilities are sent with the text
+// of their tokens, and those of the tokens of a stop sequence with the final
+// response.
+func TestPredictLogprobs(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 32
+	opts.NumThread = 1
+	opts.Temperature = 0
+	opts.Logprobs = true
+
+	llm, err := New(writeTestModel(t), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	// only generate a few letters, so any pair of tokens is a valid stop
+	// sequence
+	opts.LogitBias = make(map[string]float32)
+	for _, entry := range llm.Vocab() {
+		if len(entry.Text) != 1 || entry.Text < "a" || entry.Text > "f" {
+			opts.LogitBias[strconv.Itoa(entry.ID)] = -100
+		}
+	}
+
+	llm.SetOptions(opts)
+
+	type result struct {
+		response string
+		tokens   []string
+		final    []string
+	}
+
+	run := func() result {
+		var r result
+		if err := llm.Predict(context.Background(), nil, " hello world", nil, func(resp api.GenerateResponse) {
+			for _, token := range resp.Tokens {
+				if resp.Done {
+					r.final = append(r.final, token.Text)
+				} else {
+					r.tokens = append(r.tokens, token.Text)
+				}
+			}
+
+			if !resp.Done {
+				r.response += resp.Response
+
+				// only tokens whose text was sent have been attached
+				if !strings.HasPrefix(r.response, strings.Join(r.tokens, "")) {
+					t.Errorf("tokens %q are ahead of the response %q", r.tokens, r.response)
+				}
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return r
+	}
+
+	all := run()
+	texts := append(all.tokens, all.final...)
+	text := strings.Join(texts, "")
+	if !strings.HasPrefix(text, all.response) {
+		t.Fatalf("expected the tokens %q to make up the response %q", texts, all.response)
+	}
+
+	// stop at a pair of tokens that doesn't occur earlier in the response
+	for k, offset := 1, len(texts[0]); k+1 < len(texts); k, offset = k+1, offset+len(texts[k]) {
+		stop := texts[k] + texts[k+1]
+		if strings.Index(text, stop) != offset {
+			continue
+		}
+
+		opts.Stop = []string{stop}
+		llm.SetOptions(opts)
+
+		got := run()
+		if got.response != text[:offset] {
+			t.Errorf("expected %q, got %q", text[:offset], got.response)
+		}
+
+		if !reflect.DeepEqual(got.tokens, texts[:k]) || !reflect.DeepEqual(got.final, texts[k:k+2]) {
+			t.Errorf("expected tokens %q and %q in the final response, got %q and %q", texts[:k], texts[k:k+2], got.tokens, got.final)
+		}
+
+		return
+	}
+
+	t.Fatalf("no stop sequence found in %q", texts)
+}
+
+func TestPredictCompletions(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 32
+	opts.NumThread = 1
+	opts.Seed = 42
+	opts.N = 2
+
+	llm, err := New(writeTestModel(t), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	completions := func() [2]string {
+		var responses [2]string
+		if err := llm.Predict(context.Background(), nil, " hello world", nil, func(r api.GenerateResponse) {
+			responses[r.Index] += r.Response
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return responses
+	}
+
+	want := completions()
+	if want[0] == want[1] {
+		t.Errorf("expected different completions, got %q twice", want[0])
+	}
+
+	if got := completions(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+// writeTestAdapter writes a LoRA adapter for the model from writeTestModel
+// that changes the query weights of its first layer.
+func writeTestAdapter(t *testing.T) string {
+	t.Helper()
+
+	const (
+		numEmbd = 32
+		rank    = 4
+	)
+
+	var b bytes.Buffer
+	write := func(vs ...any) {
+		for _, v := range vs {
+			if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// magic "ggla", version 1, rank and alpha
+	write(uint32(0x67676c61), uint32(1), int32(rank), int32(rank))
+
+	r := rand.New(rand.NewSource(2))
+	for _, name := range []string{"layers.0.attention.wq.weight.loraA", "layers.0.attention.wq.weight.loraB"} {
+		write(int32(2), int32(len(name)), int32(0), int32(rank), int32(numEmbd), []byte(name))
+		b.Write(make([]byte, -b.Len()&31))
+
+		data := make([]float32, rank*numEmbd)
+		for i := range data {
+			data[i] = float32(r.NormFloat64())
+		}
+
+		write(data)
+	}
+
+	path := filepath.Join(t.TempDir(), "adapter.bin")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestAdapter(t *testing.T) {
+	model := writeTestModel(t)
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 32
+	opts.NumThread = 1
+	opts.Seed = 42
+
+	load := func(adapters ...string) string {
+		llm, err := New(model, adapters, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer llm.Close()
+
+		return predict(t, llm, " hello world")
+	}
+
+	base := load()
+
+	adapter := writeTestAdapter(t)
+	want := load(adapter)
+	if want == base {
+		t.Errorf("expected the adapter to change the response, got %q", want)
+	}
+
+	if got := load(adapter); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// the base model is unchanged by loading an adapter on top of it
+	if got := load(); got != base {
+		t.Errorf("expected %q without the adapter, got %q", base, got)
+	}
+
+	if _, err := New(model, []string{model}, opts); err == nil {
+		t.Error("expected an error applying a model as an adapter")
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	model := writeTestModel(t)
+
+	ft, err := ParseFileType("q4_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quantized := filepath.Join(t.TempDir(), "model-q4_0.bin")
+	if err := Quantize(model, quantized, ft); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := os.Stat(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := os.Stat(quantized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Size() >= src.Size() {
+		t.Errorf("expected the quantized model to be smaller than %d bytes, got %d", src.Size(), dst.Size())
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 8
+	opts.NumThread = 1
+
+	llm, err := New(quantized, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	if predict(t, llm, " hello world") == "" {
+		t.Error("expected a response from the quantized model")
+	}
+
+	// quantized tensors aren't quantized again
+	q8, err := ParseFileType("q8_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Quantize(quantized, filepath.Join(t.TempDir(), "model-q8_0.bin"), q8); err == nil {
+		t.Error("expected an error quantizing a quantized model")
+	}
+
+	if _, err := ParseFileType("q3"); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+func TestScoreBatches(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 64
+	opts.NumThread = 1
+	opts.LogitsAll = true
+
+	model := writeTestModel(t)
+	candidates := []string{" the cat", " a dog is barking"}
+
+	score := func(numBatch int) []api.Score {
+		opts.NumBatch = numBatch
+
+		llm, err := New(model, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer llm.Close()
+
+		scores, err := llm.Score(" hello world", candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return scores
+	}
+
+	// the prompt and candidates span several batches of 4 tokens
+	want := score(512)
+	got := score(4)
+	for i := range want {
+		if len(got[i].Tokens) != len(want[i].Tokens) {
+			t.Fatalf("expected %d tokens, got %d", len(want[i].Tokens), len(got[i].Tokens))
+		}
+
+		for j := range want[i].Tokens {
+			if d := got[i].Tokens[j].Logprob - want[i].Tokens[j].Logprob; d > 1e-3 || d < -1e-3 {
+				t.Errorf("%q token %d: expected log probability %f, got %f", candidates[i], j, want[i].Tokens[j].Logprob, got[i].Tokens[j].Logprob)
+			}
+		}
+	}
+}
+
+func TestEmbeddingContext(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 16
+	opts.NumThread = 1
+	opts.EmbeddingOnly = true
+
+	llm, err := New(writeTestModel(t), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	if _, err := llm.Embedding(" hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	// every byte of the input is a token, which doesn't fit the context
+	if _, err := llm.Embedding(strings.Repeat("x", 64)); err == nil {
+		t.Error("expected an error for an input longer than the context")
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 16
+	opts.NumThread = 1
+	opts.VocabOnly = true
+
+	llm, err := New(writeTestModel(t), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	cases := []struct {
+		prompt string
+		want   []int
+	}{
+		{"", []int{1}},
+		// byte tokens follow the three special tokens
+		{"hi", []int{1, 'h' + 3, 'i' + 3}},
+	}
+
+	for _, tt := range cases {
+		got, err := llm.Tokenize(tt.prompt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %v, want %v", tt.prompt, got, tt.want)
+		}
+	}
+}
+
+func TestPredictSavedStates(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 8
+	opts.NumThread = 1
+	opts.Seed = 42
+
+	llm, err := New(writeTestModel(t), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	run := func(prompt string) api.GenerateResponse {
+		var final api.GenerateResponse
+		var response string
+		if err := llm.Predict(context.Background(), nil, prompt, nil, func(r api.GenerateResponse) {
+			response += r.Response
+			if r.Done {
+				final = r
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		final.Response = response
+		return final
+	}
+
+	// more conversations than there are saved states, so the oldest saved
+	// state is evicted as each new conversation replaces the current one
+	var prompts []string
+	for i := 0; i < maxStates+2; i++ {
+		prompts = append(prompts, fmt.Sprintf(" the cat %d is a dog", i))
+	}
+
+	first := make(map[string]api.GenerateResponse)
+	for _, prompt := range prompts {
+		first[prompt] = run(prompt)
+	}
+
+	// the oldest saved conversation continues from its kv cache, which
+	// must not be evicted to make room for the current one
+	oldest := prompts[1]
+	got := run(oldest)
+	if got.Response != first[oldest].Response {
+		t.Errorf("expected %q, got %q", first[oldest].Response, got.Response)
+	}
+
+	if got.PromptEvalCount >= first[oldest].PromptEvalCount {
+		t.Errorf("expected the saved state to be reused, evaluated %d prompt tokens", got.PromptEvalCount)
+	}
+
+	// the conversation evicted first is evaluated again
+	if got := run(prompts[0]); got.Response != first[prompts[0]].Response {
+		t.Errorf("expected %q, got %q", first[prompts[0]].Response, got.Response)
+	}
+}
+
+func TestSessionRestore(t *testing.T) {
+	model := writeTestModel(t)
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 80
+	opts.NumThread = 1
+	opts.Seed = 42
+
+	run := func(llm *LLM, prevContext []int, prompt string) api.GenerateResponse {
+		var final api.GenerateResponse
+		var response string
+		if err := llm.Predict(context.Background(), prevContext, prompt, nil, func(r api.GenerateResponse) {
+			response += r.Response
+			if r.Done {
+				final = r
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		final.Response = response
+		return final
+	}
+
+	llm, err := New(model, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	// the conversation outgrows the context of the response, which only
+	// holds the last half of the context window
+	run(llm, nil, " hello world")
+	session := llm.Context()
+	if len(session) <= opts.NumCtx/2 {
+		t.Fatalf("expected more than %d tokens in the kv cache, got %d", opts.NumCtx/2, len(session))
+	}
+
+	path := filepath.Join(t.TempDir(), "session.bin")
+	if err := llm.SaveSession(path); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.NumPredict = 8
+	llm.SetOptions(opts)
+	want := run(llm, session, " the cat")
+
+	restored, err := New(model, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if err := restored.LoadSession(path, session); err != nil {
+		t.Fatal(err)
+	}
+
+	got := run(restored, session, " the cat")
+	if got.Response != want.Response {
+		t.Errorf("expected %q, got %q", want.Response, got.Response)
+	}
+
+	// only the new prompt is evaluated
+	if prompt, err := restored.Tokenize(" the cat"); err != nil {
+		t.Fatal(err)
+	} else if got.PromptEvalCount != len(prompt) {
+		t.Errorf("expected %d prompt tokens to be evaluated, got %d", len(prompt), got.PromptEvalCount)
+	}
+}
+
+// TestSessionTurns continues a conversation through a session file and
+// through the context of each response, which must generate the same text.
+func TestSessionTurns(t *testing.T) {
+	model := writeTestModel(t)
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 128
+	opts.NumPredict = 8
+	opts.NumThread = 1
+	opts.Seed = 42
+
+	run := func(llm *LLM, prevContext []int, prompt string) api.GenerateResponse {
+		var final api.GenerateResponse
+		var response string
+		if err := llm.Predict(context.Background(), prevContext, prompt, nil, func(r api.GenerateResponse) {
+			response += r.Response
+			if r.Done {
+				final = r
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		final.Response = response
+		return final
+	}
+
+	chained, err := New(model, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chained.Close()
+
+	first := run(chained, nil, " hello world")
+	if first.DoneReason != api.DoneReasonLength {
+		t.Fatalf("expected the response to stop at num_predict, got %q", first.DoneReason)
+	}
+
+	want := run(chained, first.Context, " the cat")
+
+	llm, err := New(model, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Close()
+
+	run(llm, nil, " hello world")
+
+	path := filepath.Join(t.TempDir(), "session.bin")
+	if err := llm.SaveSession(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the final token of the response, which is only evaluated with the
+	// next prompt, is part of the session
+	session := llm.Context()
+	if !reflect.DeepEqual(session, first.Context) {
+		t.Fatalf("expected the session to hold %v, got %v", first.Context, session)
+	}
+
+	// the kv cache already holds the session, so the file isn't read
+	if err := llm.LoadSession(filepath.Join(t.TempDir(), "missing.bin"), session); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := New(model, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if err := restored.LoadSession(path, session); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, llm := range []*LLM{llm, restored} {
+		if got := run(llm, session, " the cat"); got.Response != want.Response {
+			t.Errorf("expected %q, got %q", want.Response, got.Response)
+		}
+	}
+}
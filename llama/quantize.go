@@ -0,0 +1,54 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include "llama.h"
+*/
+import "C"
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// FileType is the type most tensors of a model are stored as.
+type FileType C.enum_llama_ftype
+
+var fileTypes = map[string]FileType{
+	"f32":  C.LLAMA_FTYPE_ALL_F32,
+	"f16":  C.LLAMA_FTYPE_MOSTLY_F16,
+	"q4_0": C.LLAMA_FTYPE_MOSTLY_Q4_0,
+	"q4_1": C.LLAMA_FTYPE_MOSTLY_Q4_1,
+	"q5_0": C.LLAMA_FTYPE_MOSTLY_Q5_0,
+	"q5_1": C.LLAMA_FTYPE_MOSTLY_Q5_1,
+	"q8_0": C.LLAMA_FTYPE_MOSTLY_Q8_0,
+}
+
+// ParseFileType returns the file type named s, such as q4_0.
+func ParseFileType(s string) (FileType, error) {
+	t, ok := fileTypes[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("llama: unknown quantization type %q", s)
+	}
+
+	return t, nil
+}
+
+// Quantize writes the model in src to dst with its tensors converted to t.
+// The tensors of src must be f32 or f16.
+func Quantize(src, dst string, t FileType) error {
+	cSrc := C.CString(src)
+	defer C.free(unsafe.Pointer(cSrc))
+
+	cDst := C.CString(dst)
+	defer C.free(unsafe.Pointer(cDst))
+
+	params := C.llama_model_quantize_default_params()
+	params.ftype = C.enum_llama_ftype(t)
+
+	if rc := C.llama_model_quantize(cSrc, cDst, &params); rc != 0 {
+		return fmt.Errorf("llama: failed to quantize %s", src)
+	}
+
+	return nil
+}
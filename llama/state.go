@@ -0,0 +1,225 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include "llama.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// maxStates is the number of kv caches kept for conversations other than
+// the one currently loaded.
+const maxStates = 4
+
+// state is a copy of the kv cache of a context and the tokens it contains.
+type state struct {
+	embd []C.llama_token
+	data unsafe.Pointer
+	size C.size_t
+}
+
+// copyState copies the state of ctx, which includes its kv cache, logits
+// and random number generator.
+func copyState(ctx *C.struct_llama_context) *state {
+	data := C.malloc(C.llama_get_state_size(ctx))
+	size := C.llama_copy_state_data(ctx, (*C.uint8_t)(data))
+	return &state{data: C.realloc(data, size), size: size}
+}
+
+// restore replaces the state of ctx with s, which remains usable.
+func (s *state) restore(ctx *C.struct_llama_context) {
+	C.llama_set_state_data(ctx, (*C.uint8_t)(s.data))
+}
+
+func (s *state) free() {
+	C.free(s.data)
+}
+
+// saveState copies the kv cache of the context, evicting the least recently
+// used saved state if there are too many.
+func (llm *LLM) saveState() {
+	if len(llm.embd) == 0 {
+		return
+	}
+
+	s := copyState(llm.ctx)
+	s.embd = llm.embd
+
+	llm.states = append(llm.states, s)
+	if len(llm.states) > maxStates {
+		llm.states[0].free()
+		llm.states = llm.states[1:]
+	}
+}
+
+// takeState removes s from the saved states so it can't be evicted.
+func (llm *LLM) takeState(s *state) {
+	for i := range llm.states {
+		if llm.states[i] == s {
+			llm.states = append(llm.states[:i], llm.states[i+1:]...)
+			break
+		}
+	}
+}
+
+// loadState replaces the kv cache of the context with s, which must not be
+// one of the saved states.
+func (llm *LLM) loadState(s *state) {
+	s.restore(llm.ctx)
+	llm.embd = s.embd
+	s.free()
+}
+
+// prepare makes the kv cache hold the longest available prefix of input,
+// restoring a saved state if one shares more of input than the current kv
+// cache does. It returns the number of tokens of input already evaluated.
+func (llm *LLM) prepare(input []C.llama_token) int {
+	numPast := commonPrefix(llm.embd, input)
+
+	var best *state
+	for _, s := range llm.states {
+		if n := commonPrefix(s.embd, input); n > numPast {
+			numPast, best = n, s
+		}
+	}
+
+	if best != nil {
+		// saving the current state may evict best otherwise
+		llm.takeState(best)
+	}
+
+	if numPast < len(llm.embd) {
+		// input diverges from the current conversation, which would be
+		// overwritten, so keep a copy to continue it later
+		llm.saveState()
+	}
+
+	if best != nil {
+		llm.loadState(best)
+	}
+
+	// the last token is always evaluated to get its logits
+	if numPast >= len(input) {
+		numPast = len(input) - 1
+	}
+
+	llm.embd = llm.embd[:numPast]
+	return numPast
+}
+
+// CacheSize returns the size in bytes of the saved states and the guidance
+// context, which are held in addition to the model's weights.
+func (llm *LLM) CacheSize() int64 {
+	var size int64
+	for _, s := range llm.states {
+		size += int64(s.size)
+	}
+
+	if llm.guidance != nil {
+		size += int64(C.llama_get_state_size(llm.guidance))
+	}
+
+	return size
+}
+
+func (llm *LLM) freeStates() {
+	for _, s := range llm.states {
+		s.free()
+	}
+
+	llm.states = nil
+}
+
+func commonPrefix(a, b []C.llama_token) int {
+	var n int
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+// LoadSession makes the kv cache continue from context, the tokens of a
+// session written to path by SaveSession. The file is only read if neither
+// the kv cache nor a saved state already holds them.
+func (llm *LLM) LoadSession(path string, context []int) error {
+	tokens := make([]C.llama_token, len(context))
+	for i := range context {
+		tokens[i] = C.llama_token(context[i])
+	}
+
+	if commonPrefix(llm.embd, tokens) == len(tokens) {
+		return nil
+	}
+
+	for _, s := range llm.states {
+		if commonPrefix(s.embd, tokens) == len(tokens) {
+			// the next prediction restores it
+			return nil
+		}
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	// keep the current conversation in case it is continued later, unless
+	// the session is a continuation of it
+	if commonPrefix(llm.embd, tokens) < len(llm.embd) {
+		llm.saveState()
+	}
+
+	llm.embd, llm.next = nil, nil
+
+	buf := make([]C.llama_token, llm.NumCtx)
+	var n C.size_t
+	if !C.llama_load_session_file(llm.ctx, cPath, unsafe.SliceData(buf), C.size_t(len(buf)), &n) {
+		return fmt.Errorf("llama: failed to load session file %s", path)
+	}
+
+	llm.embd = buf[:n]
+	return nil
+}
+
+// Context returns the tokens of the current conversation: those in the kv
+// cache followed by any not evaluated yet. Unlike the context of a
+// response, it is never truncated, so passing it to Predict after
+// LoadSession continues from the cache without evaluating it again.
+func (llm *LLM) Context() []int {
+	context := make([]int, 0, len(llm.embd)+len(llm.next))
+	for _, token := range llm.embd {
+		context = append(context, int(token))
+	}
+
+	for _, token := range llm.next {
+		context = append(context, int(token))
+	}
+
+	return context
+}
+
+// SaveSession writes the kv cache and the tokens it holds to path. The
+// tokens of the conversation not evaluated yet are evaluated first, if they
+// fit in the context, so the session continues from all of Context.
+func (llm *LLM) SaveSession(path string) error {
+	if len(llm.next) > 0 && len(llm.embd)+len(llm.next) <= llm.NumCtx {
+		if err := llm.eval(llm.next, len(llm.embd)); err != nil {
+			return err
+		}
+
+		// embd may share its array with a saved state
+		llm.embd = append(llm.embd[:len(llm.embd):len(llm.embd)], llm.next...)
+		llm.next = nil
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	if !C.llama_save_session_file(llm.ctx, cPath, unsafe.SliceData(llm.embd), C.size_t(len(llm.embd))) {
+		return fmt.Errorf("llama: failed to save session file %s", path)
+	}
+
+	return nil
+}
@@ -1,5 +1,7 @@
 package llama
 
+import "strings"
+
 type node[T any] struct {
 	t    T
 	next *node[T]
@@ -102,3 +104,36 @@ func (d *deque[T]) Data() (data []T) {
 
 	return data
 }
+
+// stopIndex returns the index of the first stop sequence in s, or -1 if s
+// contains none.
+func stopIndex(s string, stops []string) int {
+	index := -1
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+
+		if i := strings.Index(s, stop); i >= 0 && (index < 0 || i < index) {
+			index = i
+		}
+	}
+
+	return index
+}
+
+// partialStopLen returns the length of the longest suffix of s that is a
+// prefix of a stop sequence.
+func partialStopLen(s string, stops []string) int {
+	var longest int
+	for _, stop := range stops {
+		for n := len(stop) - 1; n > longest; n-- {
+			if strings.HasSuffix(s, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+
+	return longest
+}
@@ -0,0 +1,104 @@
+package llama
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStopIndex(t *testing.T) {
+	cases := []struct {
+		s     string
+		stops []string
+		want  int
+	}{
+		{"hello world", nil, -1},
+		{"hello world", []string{""}, -1},
+		{"hello world", []string{"", "world"}, 6},
+		{"hello world", []string{"planet"}, -1},
+		{"hello world", []string{"world", "o w"}, 4},
+		{"hello world", []string{"lo", "llo"}, 2},
+		{"### Instruction:", []string{"###", "### Instruction:"}, 0},
+		{"aab", []string{"ab"}, 1},
+	}
+
+	for _, tt := range cases {
+		if got := stopIndex(tt.s, tt.stops); got != tt.want {
+			t.Errorf("stopIndex(%q, %q) = %d, want %d", tt.s, tt.stops, got, tt.want)
+		}
+	}
+}
+
+func TestPartialStopLen(t *testing.T) {
+	cases := []struct {
+		s     string
+		stops []string
+		want  int
+	}{
+		{"hello", nil, 0},
+		{"hello", []string{""}, 0},
+		{"hello ##", []string{"###"}, 2},
+		{"hello #", []string{"###"}, 1},
+		// stopIndex is checked first, so only the suffix matters
+		{"hello ###", []string{"###"}, 2},
+		{"hello", []string{"world"}, 0},
+		{"hello wor", []string{"world", "or"}, 3},
+		{"hello wo", []string{"o wor", "wow"}, 4},
+		{"aa", []string{"aab"}, 2},
+	}
+
+	for _, tt := range cases {
+		if got := partialStopLen(tt.s, tt.stops); got != tt.want {
+			t.Errorf("partialStopLen(%q, %q) = %d, want %d", tt.s, tt.stops, got, tt.want)
+		}
+	}
+}
+
+// TestStopTokens streams tokens through stopIndex and partialStopLen the way
+// generate does, so stop sequences may span several tokens.
+func TestStopTokens(t *testing.T) {
+	cases := []struct {
+		tokens []string
+		stops  []string
+		want   string
+		stop   bool
+	}{
+		{[]string{"hello", " world"}, nil, "hello world", false},
+		{[]string{"hello", " world"}, []string{""}, "hello world", false},
+		{[]string{"hello", " #", "#", "# Instruction"}, []string{"###"}, "hello ", true},
+		{[]string{"hello", " #", "# world"}, []string{"###"}, "hello ## world", false},
+		{[]string{"hel", "lo wor", "ld"}, []string{"o w", "world"}, "hell", true},
+		{[]string{"a", "a", "a", "b"}, []string{"aab"}, "a", true},
+		{[]string{"User", ":"}, []string{"User:", "Use"}, "", true},
+		{[]string{"the end", " #"}, []string{"###"}, "the end #", false},
+	}
+
+	for _, tt := range cases {
+		var sb strings.Builder
+		var pending string
+		var stop bool
+		for _, token := range tt.tokens {
+			pending += token
+			if i := stopIndex(pending, tt.stops); i >= 0 {
+				sb.WriteString(pending[:i])
+				pending = ""
+				stop = true
+				break
+			}
+
+			n := len(pending) - partialStopLen(pending, tt.stops)
+			sb.WriteString(pending[:n])
+			pending = pending[n:]
+
+			// nothing emitted may be the start of a stop sequence that the
+			// next token completes
+			if strings.Contains(sb.String(), "###") {
+				t.Errorf("%q: emitted a stop sequence in %q", tt.tokens, sb.String())
+			}
+		}
+
+		sb.WriteString(pending)
+		if got := sb.String(); got != tt.want || stop != tt.stop {
+			t.Errorf("%q with stops %q: got %q, stopped %v, want %q, stopped %v", tt.tokens, tt.stops, got, stop, tt.want, tt.stop)
+		}
+	}
+}
@@ -46,8 +46,20 @@ func Parse(reader io.Reader) ([]Command, error) {
 				return nil, fmt.Errorf("no model specified in FROM line")
 			}
 			foundModel = true
-		case "PROMPT":
-			command.Name = "prompt"
+		case "ADAPTER":
+			command.Name = "adapter"
+			command.Arg = strings.Join(fields[1:], " ")
+			if command.Arg == "" {
+				return nil, fmt.Errorf("no adapter specified in ADAPTER line")
+			}
+		case "QUANTIZE":
+			command.Name = "quantize"
+			command.Arg = strings.Join(fields[1:], " ")
+			if command.Arg == "" {
+				return nil, fmt.Errorf("no type specified in QUANTIZE line")
+			}
+		case "PROMPT", "TEMPLATE":
+			command.Name = strings.ToLower(fields[0])
 			if fields[1] == `"""` {
 				multiline = true
 				multilineCommand = &command
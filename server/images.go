@@ -15,18 +15,28 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
 
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llama"
 	"github.com/jmorganca/ollama/parser"
 )
 
 type Model struct {
-	Name      string `json:"name"`
-	ModelPath string
-	Prompt    string
-	Options   api.Options
+	Name         string `json:"name"`
+	ModelPath    string
+	AdapterPaths []string
+	Digest       string
+	Prompt       string
+	Template     string
+	Options      api.Options
 }
 
 type ManifestV2 struct {
@@ -68,13 +78,15 @@ func (m *ManifestV2) GetTotalSize() int {
 	return total
 }
 
+var errModelNotFound = errors.New("couldn't find model")
+
 func GetManifest(mp ModelPath) (*ManifestV2, error) {
 	fp, err := mp.GetManifestPath(false)
 	if err != nil {
 		return nil, err
 	}
-	if _, err = os.Stat(fp); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("couldn't find model '%s'", mp.GetShortTagname())
+	if _, err = os.Stat(fp); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w '%s'", errModelNotFound, mp.GetShortTagname())
 	}
 
 	var manifest *ManifestV2
@@ -83,6 +95,7 @@ func GetManifest(mp ModelPath) (*ManifestV2, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open file '%s'", fp)
 	}
+	defer f.Close()
 
 	decoder := json.NewDecoder(f)
 	err = decoder.Decode(&manifest)
@@ -114,12 +127,21 @@ func GetModel(name string) (*Model, error) {
 		switch layer.MediaType {
 		case "application/vnd.ollama.image.model":
 			model.ModelPath = filename
+			model.Digest = layer.Digest
+		case "application/vnd.ollama.image.adapter":
+			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.ollama.image.prompt":
 			data, err := os.ReadFile(filename)
 			if err != nil {
 				return nil, err
 			}
 			model.Prompt = string(data)
+		case "application/vnd.ollama.image.template":
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			model.Template = string(data)
 		case "application/vnd.ollama.image.params":
 			params, err := os.Open(filename)
 			if err != nil {
@@ -139,6 +161,135 @@ func GetModel(name string) (*Model, error) {
 	return model, nil
 }
 
+// Parameters returns the options the model sets to other than their
+// default values, keyed by their names in a PARAMETER instruction.
+func (m *Model) Parameters() map[string]any {
+	defaults := reflect.ValueOf(api.DefaultOptions())
+	opts := reflect.ValueOf(m.Options)
+
+	params := make(map[string]any)
+	for _, field := range reflect.VisibleFields(opts.Type()) {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || len(field.Index) > 1 {
+			continue
+		}
+
+		v := opts.FieldByIndex(field.Index)
+
+		// zero values are unset and don't override the defaults
+		if v.IsZero() || reflect.DeepEqual(v.Interface(), defaults.FieldByIndex(field.Index).Interface()) {
+			continue
+		}
+
+		params[name] = v.Interface()
+	}
+
+	return params
+}
+
+// Modelfile returns a Modelfile that creates the model from its layers.
+func (m *Model) Modelfile() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Modelfile generated by \"ollama show\"\n")
+	fmt.Fprintf(&sb, "# To build a new Modelfile based on this one, replace the FROM line with:\n")
+	fmt.Fprintf(&sb, "# FROM %s\n\n", ParseModelPath(m.Name).GetShortTagname())
+	fmt.Fprintf(&sb, "FROM %s\n", m.ModelPath)
+
+	for _, adapter := range m.AdapterPaths {
+		fmt.Fprintf(&sb, "ADAPTER %s\n", adapter)
+	}
+
+	text := func(instruction, s string) {
+		switch {
+		case s == "":
+		case strings.HasPrefix(s, "\n"):
+			// a multiline string starts with the newline after its opening quotes
+			fmt.Fprintf(&sb, "%s \"\"\"%s\n\"\"\"\n", instruction, s)
+		case !strings.Contains(s, "\n"):
+			fmt.Fprintf(&sb, "%s %s\n", instruction, s)
+		default:
+			fmt.Fprintf(&sb, "%s \"\"\"\n%s\n\"\"\"\n", instruction, s)
+		}
+	}
+
+	text("PROMPT", m.Prompt)
+	text("TEMPLATE", m.Template)
+
+	params := m.Parameters()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		switch v := params[name].(type) {
+		case []string:
+			for _, s := range v {
+				// string lists are unquoted when the model is created
+				fmt.Fprintf(&sb, "PARAMETER %s %s\n", name, strconv.Quote(s))
+			}
+		case map[string]float32:
+			// logit biases can't be set with PARAMETER
+		default:
+			fmt.Fprintf(&sb, "PARAMETER %s %v\n", name, v)
+		}
+	}
+
+	return sb.String()
+}
+
+// ChatPrompt renders a conversation with the model's template. Models
+// without a template render each user message with their prompt template
+// and follow it with the assistant's reply.
+func (m *Model) ChatPrompt(messages []api.Message) (string, error) {
+	if m.Template != "" {
+		tmpl, err := template.New("").Parse(m.Template)
+		if err != nil {
+			return "", err
+		}
+
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, struct{ Messages []api.Message }{messages}); err != nil {
+			return "", err
+		}
+
+		return sb.String(), nil
+	}
+
+	tmpl, err := template.New("").Parse(m.Prompt)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	var turns bool
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user":
+			// a non-empty context tells the template this isn't the first
+			// turn, which a system message alone doesn't make it
+			var context []int
+			if turns {
+				context = []int{0}
+			}
+
+			if err := tmpl.Execute(&sb, api.GenerateRequest{Prompt: msg.Content, Context: context}); err != nil {
+				return "", err
+			}
+
+			turns = true
+		case "assistant":
+			sb.WriteString(msg.Content)
+			turns = true
+		case "system":
+			sb.WriteString(msg.Content)
+		}
+	}
+
+	return sb.String(), nil
+}
+
 func getAbsPath(fp string) (string, error) {
 	if strings.HasPrefix(fp, "~/") {
 		parts := strings.Split(fp, "/")
@@ -162,7 +313,11 @@ func CreateModel(name string, mf io.Reader, fn func(status string)) error {
 	}
 
 	var layers []*LayerWithBuffer
-	params := make(map[string]string)
+	params := make(map[string][]string)
+
+	// modelPath is the file of the model layer, which is quantized to
+	// quantize if the modelfile sets it
+	var modelPath, quantize string
 
 	for _, c := range commands {
 		log.Printf("[%s] - %s\n", c.Name, c.Arg)
@@ -179,6 +334,7 @@ func CreateModel(name string, mf io.Reader, fn func(status string)) error {
 				}
 
 				fn("creating model layer")
+				modelPath = fp
 				file, err := os.Open(fp)
 				if err != nil {
 					fn(fmt.Sprintf("couldn't find model '%s'", c.Arg))
@@ -202,8 +358,43 @@ func CreateModel(name string, mf io.Reader, fn func(status string)) error {
 						return err
 					}
 					layers = append(layers, newLayer)
+
+					if l.MediaType == "application/vnd.ollama.image.model" {
+						if modelPath, err = GetBlobsPath(l.Digest); err != nil {
+							return err
+						}
+					}
 				}
 			}
+		case "quantize":
+			if _, err := llama.ParseFileType(c.Arg); err != nil {
+				fn(fmt.Sprintf("error: %v", err))
+				return err
+			}
+
+			quantize = c.Arg
+		case "adapter":
+			fn("creating adapter layer")
+			fp, err := getAbsPath(c.Arg)
+			if err != nil {
+				fn("error determing path. exiting.")
+				return err
+			}
+
+			file, err := os.Open(fp)
+			if err != nil {
+				fn(fmt.Sprintf("couldn't find adapter '%s'", c.Arg))
+				return fmt.Errorf("failed to open file: %v", err)
+			}
+			defer file.Close()
+
+			l, err := CreateLayer(file)
+			if err != nil {
+				fn(fmt.Sprintf("couldn't create adapter layer: %v", err))
+				return fmt.Errorf("failed to create layer: %v", err)
+			}
+			l.MediaType = "application/vnd.ollama.image.adapter"
+			layers = append(layers, l)
 		case "prompt":
 			fn("creating prompt layer")
 			// remove the prompt layer if one exists
@@ -217,8 +408,35 @@ func CreateModel(name string, mf io.Reader, fn func(status string)) error {
 			}
 			l.MediaType = "application/vnd.ollama.image.prompt"
 			layers = append(layers, l)
+		case "template":
+			fn("creating template layer")
+			layers = removeLayerFromLayers(layers, "application/vnd.ollama.image.template")
+
+			l, err := CreateLayer(strings.NewReader(c.Arg))
+			if err != nil {
+				fn(fmt.Sprintf("couldn't create template layer: %v", err))
+				return fmt.Errorf("failed to create layer: %v", err)
+			}
+			l.MediaType = "application/vnd.ollama.image.template"
+			layers = append(layers, l)
 		default:
-			params[c.Name] = c.Arg
+			params[c.Name] = append(params[c.Name], c.Arg)
+		}
+	}
+
+	if quantize != "" {
+		fn(fmt.Sprintf("quantizing model to %s", quantize))
+		l, err := quantizeModel(modelPath, quantize, fn)
+		if err != nil {
+			fn(fmt.Sprintf("couldn't quantize model: %v", err))
+			return err
+		}
+
+		// the quantized model replaces the original, which isn't saved
+		for i := range layers {
+			if layers[i].MediaType == "application/vnd.ollama.image.model" {
+				layers[i] = l
+			}
 		}
 	}
 
@@ -256,6 +474,9 @@ func CreateModel(name string, mf io.Reader, fn func(status string)) error {
 	}
 	layers = append(layers, cfg)
 
+	// the layers are unreferenced until the manifest is written
+	defer useBlobs(append(digests, cfg.Digest)...)()
+
 	err = SaveLayers(layers, fn, false)
 	if err != nil {
 		fn(fmt.Sprintf("error saving layers: %v", err))
@@ -274,6 +495,51 @@ func CreateModel(name string, mf io.Reader, fn func(status string)) error {
 	return nil
 }
 
+// quantizeModel quantizes the model in path to the type named t and returns
+// it as a model layer, reporting how much has been written while it runs.
+func quantizeModel(path, t string, fn func(status string)) (*LayerWithBuffer, error) {
+	ft, err := llama.ParseFileType(t)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.CreateTemp("", "ollama-quantize-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- llama.Quantize(path, out.Name(), ft)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if fi, err := out.Stat(); err == nil {
+				fn(fmt.Sprintf("quantizing model to %s (%s written)", t, humanize.Bytes(uint64(fi.Size()))))
+			}
+		case err := <-done:
+			if err != nil {
+				return nil, err
+			}
+
+			l, err := CreateLayer(out)
+			if err != nil {
+				return nil, err
+			}
+
+			l.MediaType = "application/vnd.ollama.image.model"
+			return l, nil
+		}
+	}
+}
+
 func removeLayerFromLayers(layers []*LayerWithBuffer, mediaType string) []*LayerWithBuffer {
 	j := 0
 	for _, l := range layers {
@@ -341,6 +607,180 @@ func CreateManifest(name string, cfg *LayerWithBuffer, layers []*Layer) error {
 	return os.WriteFile(fp, manifestJSON, 0o644)
 }
 
+var (
+	// blobsMu guards blob files against being deleted while they're used
+	blobsMu sync.Mutex
+	// blobsInUse counts the users of each blob written or read before a
+	// manifest references it, such as a pull that is downloading it
+	blobsInUse = make(map[string]int)
+)
+
+// useBlobs keeps the blobs of digests from being deleted until the returned
+// function is called.
+func useBlobs(digests ...string) func() {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+
+	for _, digest := range digests {
+		blobsInUse[digest]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			blobsMu.Lock()
+			defer blobsMu.Unlock()
+
+			for _, digest := range digests {
+				if blobsInUse[digest]--; blobsInUse[digest] == 0 {
+					delete(blobsInUse, digest)
+				}
+			}
+		})
+	}
+}
+
+// CopyModel writes the manifest of src as the manifest of dst, so that dst
+// uses the same blobs.
+func CopyModel(src, dst string) error {
+	srcPath := ParseModelPath(src)
+	dstPath := ParseModelPath(dst)
+
+	srcManifest, err := srcPath.GetManifestPath(false)
+	if err != nil {
+		return err
+	}
+
+	dstManifest, err := dstPath.GetManifestPath(true)
+	if err != nil {
+		return err
+	}
+
+	// keep the blobs of src if it's deleted before the copy is written
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+
+	manifest, err := os.ReadFile(srcManifest)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w '%s'", errModelNotFound, srcPath.GetShortTagname())
+	} else if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dstManifest, manifest, 0o644)
+}
+
+// DeleteModel removes the manifest of name and every blob no other
+// manifest references.
+func DeleteModel(name string) error {
+	mp := ParseModelPath(name)
+
+	fp, err := mp.GetManifestPath(false)
+	if err != nil {
+		return err
+	}
+
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+
+	if _, err := os.Stat(fp); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w '%s'", errModelNotFound, mp.GetShortTagname())
+	}
+
+	if err := os.Remove(fp); err != nil {
+		return err
+	}
+
+	root, err := GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	// remove the directories left empty, stopping at the first that isn't
+	for dir := filepath.Dir(fp); dir != root; dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+
+	return deleteUnusedBlobs()
+}
+
+// deleteUnusedBlobs removes the blobs that neither a manifest nor a
+// running operation uses, and any partial download that was abandoned. The
+// caller must hold blobsMu.
+func deleteUnusedBlobs() error {
+	root, err := GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	// unknown is set if a manifest can't be read, in which case any blob
+	// may be in use
+	var unknown bool
+	used := make(map[string]bool)
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			log.Printf("couldn't read manifests, keeping all blobs: %v", err)
+			unknown = true
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		bts, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("couldn't read manifest %s, keeping all blobs: %v", path, err)
+			unknown = true
+			return nil
+		}
+
+		var manifest ManifestV2
+		if err := json.Unmarshal(bts, &manifest); err != nil {
+			log.Printf("couldn't read manifest %s, keeping all blobs: %v", path, err)
+			unknown = true
+			return nil
+		}
+
+		used[manifest.Config.Digest] = true
+		for _, layer := range manifest.Layers {
+			used[layer.Digest] = true
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(blobs)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		digest, partial := strings.CutSuffix(entry.Name(), "-partial")
+		if blobsInUse[digest] > 0 || (used[digest] || unknown) && !partial {
+			continue
+		}
+
+		log.Printf("deleting blob %s", entry.Name())
+		if err := os.Remove(filepath.Join(blobs, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func GetLayerWithBufferFromLayer(layer *Layer) (*LayerWithBuffer, error) {
 	fp, err := GetBlobsPath(layer.Digest)
 	if err != nil {
@@ -361,7 +801,10 @@ func GetLayerWithBufferFromLayer(layer *Layer) (*LayerWithBuffer, error) {
 	return newLayer, nil
 }
 
-func paramsToReader(params map[string]string) (io.Reader, error) {
+// paramsToReader converts Modelfile parameters to an api.Options JSON
+// document. List options such as stop take every value given for them, other
+// options take the last value.
+func paramsToReader(params map[string][]string) (io.Reader, error) {
 	opts := api.DefaultOptions()
 	typeOpts := reflect.TypeOf(opts)
 
@@ -376,10 +819,11 @@ func paramsToReader(params map[string]string) (io.Reader, error) {
 
 	valueOpts := reflect.ValueOf(&opts).Elem()
 	// iterate params and set values based on json struct tags
-	for key, val := range params {
+	for key, vals := range params {
 		if opt, ok := jsonOpts[key]; ok {
 			field := valueOpts.FieldByName(opt.Name)
 			if field.IsValid() && field.CanSet() {
+				val := vals[len(vals)-1]
 				switch field.Kind() {
 				case reflect.Float32:
 					floatVal, err := strconv.ParseFloat(val, 32)
@@ -404,6 +848,27 @@ func paramsToReader(params map[string]string) (io.Reader, error) {
 					field.SetBool(boolVal)
 				case reflect.String:
 					field.SetString(val)
+				case reflect.Slice:
+					if field.Type().Elem().Kind() != reflect.String {
+						return nil, fmt.Errorf("unknown type %s for %s", field.Type(), key)
+					}
+
+					strs := make([]string, len(vals))
+					for i, val := range vals {
+						// quoted values may contain escapes such as \n
+						if len(val) >= 2 && strings.HasPrefix(val, `"`) && strings.HasSuffix(val, `"`) {
+							unquoted, err := strconv.Unquote(val)
+							if err != nil {
+								return nil, fmt.Errorf("invalid string value %s", val)
+							}
+
+							val = unquoted
+						}
+
+						strs[i] = val
+					}
+
+					field.Set(reflect.ValueOf(strs))
 				default:
 					return nil, fmt.Errorf("unknown type %s for %s", field.Kind(), key)
 				}
@@ -472,6 +937,14 @@ func PushModel(name, username, password string, fn func(status, digest string, T
 	layers = append(layers, &manifest.Config)
 	total += manifest.Config.Size
 
+	var digests []string
+	for _, layer := range layers {
+		digests = append(digests, layer.Digest)
+	}
+
+	// keep the blobs if the model is deleted while they're uploaded
+	defer useBlobs(digests...)()
+
 	for _, layer := range layers {
 		exists, err := checkBlobExistence(mp, layer.Digest, username, password)
 		if err != nil {
@@ -549,6 +1022,14 @@ func PullModel(name, username, password string, fn func(status, digest string, T
 	layers = append(layers, &manifest.Config)
 	total += manifest.Config.Size
 
+	var digests []string
+	for _, layer := range layers {
+		digests = append(digests, layer.Digest)
+	}
+
+	// the blobs are unreferenced until the manifest is written
+	defer useBlobs(digests...)()
+
 	for _, layer := range layers {
 		fn("starting download", layer.Digest, total, completed, float64(completed)/float64(total))
 		if err := downloadBlob(mp, layer.Digest, username, password, fn); err != nil {
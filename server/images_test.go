@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestChatPromptFallback(t *testing.T) {
+	m := Model{Prompt: "{{ if not .Context }}[first]{{ end }}<{{ .Prompt }}>"}
+
+	cases := []struct {
+		messages []api.Message
+		want     string
+	}{
+		{
+			[]api.Message{{Role: "user", Content: "hi"}},
+			"[first]<hi>",
+		},
+		{
+			[]api.Message{{Role: "system", Content: "be brief. "}, {Role: "user", Content: "hi"}},
+			"be brief. [first]<hi>",
+		},
+		{
+			[]api.Message{
+				{Role: "system", Content: "be brief. "},
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "hello"},
+				{Role: "user", Content: "bye"},
+			},
+			"be brief. [first]<hi>hello<bye>",
+		},
+	}
+
+	for _, tt := range cases {
+		got, err := m.ChatPrompt(tt.messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -44,7 +45,9 @@ func ParseModelPath(name string) ModelPath {
 		return ModelPath{}
 	}
 
-	colonParts := strings.Split(name, ":")
+	// the registry may have a port, so the tag follows the last colon of
+	// the repository
+	colonParts := strings.Split(slashParts[len(slashParts)-1], ":")
 	if len(colonParts) == 2 {
 		tag = colonParts[1]
 	} else {
@@ -69,19 +72,44 @@ func (mp ModelPath) GetFullTagname() string {
 }
 
 func (mp ModelPath) GetShortTagname() string {
-	if mp.Registry == DefaultRegistry && mp.Namespace == DefaultNamespace {
+	if mp.Registry != DefaultRegistry {
+		return mp.GetFullTagname()
+	}
+	if mp.Namespace == DefaultNamespace {
 		return fmt.Sprintf("%s:%s", mp.Repository, mp.Tag)
 	}
 	return fmt.Sprintf("%s/%s:%s", mp.Namespace, mp.Repository, mp.Tag)
 }
 
+var errInvalidModelPath = errors.New("invalid model name")
+
+// validate checks that each part of mp is a single path element, so the
+// manifest path stays in the manifests directory.
+func (mp ModelPath) validate() error {
+	for _, part := range []string{mp.Registry, mp.Namespace, mp.Repository, mp.Tag} {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+			return fmt.Errorf("%w '%s'", errInvalidModelPath, mp.GetFullTagname())
+		}
+	}
+
+	return nil
+}
+
 func (mp ModelPath) GetManifestPath(createDir bool) (string, error) {
-	home, err := os.UserHomeDir()
+	if err := mp.validate(); err != nil {
+		return "", err
+	}
+
+	root, err := GetManifestPath()
 	if err != nil {
 		return "", err
 	}
 
-	path := filepath.Join(home, ".ollama", "models", "manifests", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+	path := filepath.Join(root, mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+	if rel, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w '%s'", errInvalidModelPath, mp.GetFullTagname())
+	}
+
 	if createDir {
 		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 			return "", err
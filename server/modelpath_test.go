@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseModelPath(t *testing.T) {
+	cases := []struct {
+		name string
+		want ModelPath
+	}{
+		{"llama2", ModelPath{DefaultProtocolScheme, DefaultRegistry, DefaultNamespace, "llama2", DefaultTag}},
+		{"llama2:7b", ModelPath{DefaultProtocolScheme, DefaultRegistry, DefaultNamespace, "llama2", "7b"}},
+		{"team/assistant:prod", ModelPath{DefaultProtocolScheme, DefaultRegistry, "team", "assistant", "prod"}},
+		{"myregistry.local/ns/repo:tag", ModelPath{DefaultProtocolScheme, "myregistry.local", "ns", "repo", "tag"}},
+		{"localhost:5000/ns/repo", ModelPath{DefaultProtocolScheme, "localhost:5000", "ns", "repo", DefaultTag}},
+		{"localhost:5000/ns/repo:v1", ModelPath{DefaultProtocolScheme, "localhost:5000", "ns", "repo", "v1"}},
+	}
+
+	for _, tt := range cases {
+		if got := ParseModelPath(tt.name); got != tt.want {
+			t.Errorf("ParseModelPath(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetManifestPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	root := filepath.Join(home, ".ollama", "models", "manifests")
+
+	fp, err := ParseModelPath("localhost:5000/ns/repo:v1").GetManifestPath(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.Join(root, "localhost:5000", "ns", "repo", "v1"); fp != want {
+		t.Errorf("expected %s, got %s", want, fp)
+	}
+
+	for _, name := range []string{
+		"../../..:.bashrc",
+		"../x",
+		"..:latest",
+		"./x:.",
+		`ns\..\..\repo`,
+		"a/b/c/d",
+	} {
+		if fp, err := ParseModelPath(name).GetManifestPath(false); !errors.Is(err, errInvalidModelPath) {
+			t.Errorf("expected %q to be invalid, got %s", name, fp)
+		}
+	}
+}
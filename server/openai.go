@@ -0,0 +1,466 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// The /v1 routes implement a subset of the OpenAI API on top of the native
+// endpoints so tools written for it work unchanged.
+
+type openaiErrorResponse struct {
+	Error openaiError `json:"error"`
+}
+
+type openaiError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+func openaiAbort(c *gin.Context, status int, err error) {
+	kind := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		kind = "api_error"
+	}
+
+	c.JSON(status, openaiErrorResponse{Error: openaiError{Message: err.Error(), Type: kind}})
+}
+
+// openaiOptions are the sampling parameters shared by the completion
+// endpoints. Unset parameters keep the model's defaults.
+type openaiOptions struct {
+	MaxTokens        *int             `json:"max_tokens"`
+	Stop             api.StringOrList `json:"stop"`
+	Temperature      *float32         `json:"temperature"`
+	TopP             *float32         `json:"top_p"`
+	FrequencyPenalty *float32         `json:"frequency_penalty"`
+	PresencePenalty  *float32         `json:"presence_penalty"`
+	Seed             *int             `json:"seed"`
+	N                *int             `json:"n"`
+}
+
+func (o openaiOptions) apply(opts *api.Options) {
+	if o.MaxTokens != nil {
+		opts.NumPredict = *o.MaxTokens
+	}
+
+	if o.Stop != nil {
+		opts.Stop = o.Stop
+	}
+
+	if o.Temperature != nil {
+		opts.Temperature = *o.Temperature
+	}
+
+	if o.TopP != nil {
+		opts.TopP = *o.TopP
+	}
+
+	if o.FrequencyPenalty != nil {
+		opts.FrequencyPenalty = *o.FrequencyPenalty
+	}
+
+	if o.PresencePenalty != nil {
+		opts.PresencePenalty = *o.PresencePenalty
+	}
+
+	if o.Seed != nil {
+		opts.Seed = *o.Seed
+	}
+
+	if o.N != nil {
+		opts.N = *o.N
+	}
+}
+
+type openaiChatRequest struct {
+	Model    string        `json:"model"`
+	Messages []api.Message `json:"messages"`
+	Stream   bool          `json:"stream"`
+
+	openaiOptions
+}
+
+type openaiCompletionRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	Stream bool   `json:"stream"`
+
+	openaiOptions
+}
+
+type openaiUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openaiChatChoice struct {
+	Index        int          `json:"index"`
+	Message      *api.Message `json:"message,omitempty"`
+	Delta        *api.Message `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type openaiChatResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []openaiChatChoice `json:"choices"`
+	Usage   *openaiUsage       `json:"usage,omitempty"`
+}
+
+type openaiCompletionChoice struct {
+	Index        int     `json:"index"`
+	Text         string  `json:"text"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type openaiCompletionResponse struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []openaiCompletionChoice `json:"choices"`
+	Usage   *openaiUsage             `json:"usage,omitempty"`
+}
+
+type openaiEmbeddingRequest struct {
+	Model string           `json:"model"`
+	Input api.StringOrList `json:"input"`
+}
+
+type openaiEmbedding struct {
+	Object    string    `json:"object"`
+	Embedding []float64 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type openaiEmbeddingResponse struct {
+	Object string            `json:"object"`
+	Data   []openaiEmbedding `json:"data"`
+	Model  string            `json:"model"`
+	Usage  openaiUsage       `json:"usage"`
+}
+
+type openaiModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openaiModelList struct {
+	Object string        `json:"object"`
+	Data   []openaiModel `json:"data"`
+}
+
+func openaiID(prefix string) string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return prefix + hex.EncodeToString(b)
+}
+
+// openaiFinishReason maps a DoneReason to the reasons OpenAI reports.
+func openaiFinishReason(reason string) *string {
+	var finish string
+	switch reason {
+	case api.DoneReasonStop:
+		finish = "stop"
+	case api.DoneReasonLength, api.DoneReasonContextFull:
+		finish = "length"
+	default:
+		return nil
+	}
+
+	return &finish
+}
+
+// openaiCompletion is a completion collected by openaiGenerate.
+type openaiCompletion struct {
+	text   strings.Builder
+	finish *string
+}
+
+// openaiGenerate generates completions of the prompt render returns for the
+// model. If chunk is not nil, the completions are streamed as server-sent
+// events made by chunk, otherwise they are returned. It reports false if it
+// has already written an error response.
+func openaiGenerate(c *gin.Context, name string, o openaiOptions, render func(*Model) (string, error), chunk func(index int, text string, finish *string) any) ([]*openaiCompletion, openaiUsage, bool) {
+	start := time.Now()
+
+	model, err := GetModel(name)
+	if err != nil {
+		openaiAbort(c, http.StatusNotFound, err)
+		return nil, openaiUsage{}, false
+	}
+
+	opts, err := modelOptions(model, api.Options{})
+	if err != nil {
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return nil, openaiUsage{}, false
+	}
+
+	o.apply(&opts)
+
+	prompt, err := render(model)
+	if err != nil {
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return nil, openaiUsage{}, false
+	}
+
+	llm, release, err := pool.Acquire(model, opts)
+	if err != nil {
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return nil, openaiUsage{}, false
+	}
+	defer release()
+
+	var usage openaiUsage
+	if tokens, err := llm.Tokenize(prompt); err == nil {
+		usage.PromptTokens = len(tokens)
+	}
+
+	if chunk != nil {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+	}
+
+	event := func(v any) {
+		bts, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(c.Writer, "data: %s\n\n", bts)
+		c.Writer.Flush()
+	}
+
+	var completions []*openaiCompletion
+	fn := func(r api.GenerateResponse) {
+		for len(completions) <= r.Index {
+			completions = append(completions, &openaiCompletion{})
+		}
+
+		completion := completions[r.Index]
+		completion.text.WriteString(r.Response)
+		if r.Done {
+			completion.finish = openaiFinishReason(r.DoneReason)
+			usage.CompletionTokens += r.EvalCount
+		}
+
+		if chunk != nil && (r.Response != "" || r.Done) {
+			event(chunk(r.Index, r.Response, completion.finish))
+		}
+	}
+
+	err = llm.Predict(c.Request.Context(), nil, prompt, nil, fn)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		log.Printf("completion cancelled after %s", time.Since(start))
+		return nil, usage, false
+	case err != nil && chunk != nil:
+		event(openaiErrorResponse{Error: openaiError{Message: err.Error(), Type: "api_error"}})
+		return nil, usage, false
+	case err != nil:
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return nil, usage, false
+	case chunk != nil:
+		fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+		c.Writer.Flush()
+	}
+
+	return completions, usage, true
+}
+
+func openaiChatCompletions(c *gin.Context) {
+	var req openaiChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openaiAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		openaiAbort(c, http.StatusBadRequest, errors.New("messages are required"))
+		return
+	}
+
+	resp := openaiChatResponse{
+		ID:      openaiID("chatcmpl-"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+
+	render := func(model *Model) (string, error) {
+		return model.ChatPrompt(req.Messages)
+	}
+
+	var chunk func(int, string, *string) any
+	if req.Stream {
+		chunk = func(index int, text string, finish *string) any {
+			r := resp
+			r.Object = "chat.completion.chunk"
+			r.Choices = []openaiChatChoice{{
+				Index:        index,
+				Delta:        &api.Message{Role: "assistant", Content: text},
+				FinishReason: finish,
+			}}
+			return r
+		}
+	}
+
+	completions, usage, ok := openaiGenerate(c, req.Model, req.openaiOptions, render, chunk)
+	if !ok || req.Stream {
+		return
+	}
+
+	for i, completion := range completions {
+		resp.Choices = append(resp.Choices, openaiChatChoice{
+			Index:        i,
+			Message:      &api.Message{Role: "assistant", Content: completion.text.String()},
+			FinishReason: completion.finish,
+		})
+	}
+
+	resp.Usage = &usage
+	c.JSON(http.StatusOK, resp)
+}
+
+func openaiCompletions(c *gin.Context) {
+	var req openaiCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openaiAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	resp := openaiCompletionResponse{
+		ID:      openaiID("cmpl-"),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+
+	// completions continue the prompt as is, without the model's template
+	render := func(*Model) (string, error) {
+		return req.Prompt, nil
+	}
+
+	var chunk func(int, string, *string) any
+	if req.Stream {
+		chunk = func(index int, text string, finish *string) any {
+			r := resp
+			r.Choices = []openaiCompletionChoice{{Index: index, Text: text, FinishReason: finish}}
+			return r
+		}
+	}
+
+	completions, usage, ok := openaiGenerate(c, req.Model, req.openaiOptions, render, chunk)
+	if !ok || req.Stream {
+		return
+	}
+
+	for i, completion := range completions {
+		resp.Choices = append(resp.Choices, openaiCompletionChoice{
+			Index:        i,
+			Text:         completion.text.String(),
+			FinishReason: completion.finish,
+		})
+	}
+
+	resp.Usage = &usage
+	c.JSON(http.StatusOK, resp)
+}
+
+func openaiEmbeddings(c *gin.Context) {
+	var req openaiEmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openaiAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Input) == 0 {
+		openaiAbort(c, http.StatusBadRequest, errors.New("input is required"))
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		openaiAbort(c, http.StatusNotFound, err)
+		return
+	}
+
+	opts, err := modelOptions(model, api.Options{})
+	if err != nil {
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	opts.EmbeddingOnly = true
+
+	llm, release, err := pool.Acquire(model, opts)
+	if err != nil {
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer release()
+
+	resp := openaiEmbeddingResponse{Object: "list", Model: req.Model}
+	for i, input := range req.Input {
+		embedding, err := llm.Embedding(input)
+		if err != nil {
+			openaiAbort(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp.Data = append(resp.Data, openaiEmbedding{Object: "embedding", Embedding: embedding, Index: i})
+
+		if tokens, err := llm.Tokenize(input); err == nil {
+			resp.Usage.PromptTokens += len(tokens)
+		}
+	}
+
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	c.JSON(http.StatusOK, resp)
+}
+
+func openaiModels(c *gin.Context) {
+	models, err := listModels()
+	if err != nil {
+		openaiAbort(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := openaiModelList{Object: "list", Data: []openaiModel{}}
+	for _, m := range models {
+		resp.Data = append(resp.Data, openaiModel{
+			ID:      m.Name,
+			Object:  "model",
+			Created: m.ModifiedAt.Unix(),
+			OwnedBy: "ollama",
+		})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
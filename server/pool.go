@@ -0,0 +1,303 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llama"
+)
+
+const defaultKeepAlive = 5 * time.Minute
+
+// poolKey identifies a loaded model. Two requests share a loaded model only
+// if they use the same weights and the same load options.
+type poolKey struct {
+	digest   string
+	adapters string
+
+	numa          bool
+	numCtx        int
+	numBatch      int
+	numGPU        int
+	mainGPU       int
+	lowVRAM       bool
+	f16KV         bool
+	logitsAll     bool
+	vocabOnly     bool
+	useMMap       bool
+	useMLock      bool
+	embeddingOnly bool
+}
+
+func newPoolKey(model *Model, opts api.Options) poolKey {
+	return poolKey{
+		digest:        model.Digest,
+		adapters:      strings.Join(model.AdapterPaths, ":"),
+		numa:          opts.UseNUMA,
+		numCtx:        opts.NumCtx,
+		numBatch:      opts.NumBatch,
+		numGPU:        opts.NumGPU,
+		mainGPU:       opts.MainGPU,
+		lowVRAM:       opts.LowVRAM,
+		f16KV:         opts.F16KV,
+		logitsAll:     opts.LogitsAll,
+		vocabOnly:     opts.VocabOnly,
+		useMMap:       opts.UseMMap,
+		useMLock:      opts.UseMLock,
+		embeddingOnly: opts.EmbeddingOnly,
+	}
+}
+
+// poolModel is a loaded model as the pool uses it.
+type poolModel interface {
+	SetOptions(api.Options)
+	CacheSize() int64
+	Close()
+}
+
+func loadModel(model *Model, opts api.Options) (poolModel, error) {
+	return llama.New(model.ModelPath, model.AdapterPaths, opts)
+}
+
+type poolEntry struct {
+	// mu is held by the request currently using llm
+	mu  sync.Mutex
+	llm poolModel
+	err error
+
+	key  poolKey
+	size int64
+	// cacheSize is the memory held by the model's saved states, which is
+	// counted with its size
+	cacheSize int64
+	refs      int
+	timer     *time.Timer
+	// timerGen changes whenever timer is stopped, so a timer that fired
+	// before it was stopped can tell it is stale
+	timerGen int
+}
+
+// modelPool keeps loaded models resident between requests. Idle models are
+// unloaded after keepAlive and the least recently used idle models are
+// unloaded when loading another model would exceed budget.
+type modelPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	entries map[poolKey]*poolEntry
+	// idle holds unused entries, least recently used first
+	idle []*poolEntry
+	used int64
+
+	// keepAlive is how long an idle model stays loaded. Zero unloads models
+	// as soon as they are released and a negative value keeps them forever.
+	keepAlive time.Duration
+	// budget is the total size of loaded models in bytes. Zero means no limit.
+	budget int64
+
+	load func(*Model, api.Options) (poolModel, error)
+}
+
+func newModelPool(keepAlive time.Duration, budget int64) *modelPool {
+	p := &modelPool{
+		entries:   make(map[poolKey]*poolEntry),
+		keepAlive: keepAlive,
+		budget:    budget,
+		load:      loadModel,
+	}
+
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// newModelPoolFromEnv configures a model pool with OLLAMA_KEEP_ALIVE, a
+// duration such as "10m", and OLLAMA_MAX_MEMORY, a size such as "16GB".
+func newModelPoolFromEnv() (*modelPool, error) {
+	keepAlive := defaultKeepAlive
+	if s := os.Getenv("OLLAMA_KEEP_ALIVE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+
+		keepAlive = d
+	}
+
+	var budget int64
+	if s := os.Getenv("OLLAMA_MAX_MEMORY"); s != "" {
+		n, err := humanize.ParseBytes(s)
+		if err != nil {
+			return nil, err
+		}
+
+		budget = int64(n)
+	}
+
+	return newModelPool(keepAlive, budget), nil
+}
+
+// Acquire returns a loaded model for the given options, loading it if
+// necessary. The caller has exclusive use of the model until it calls the
+// returned release function.
+func (p *modelPool) Acquire(model *Model, opts api.Options) (*llama.LLM, func(), error) {
+	llm, release, err := p.acquire(model, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return llm.(*llama.LLM), release, nil
+}
+
+func (p *modelPool) acquire(model *Model, opts api.Options) (poolModel, func(), error) {
+	key := newPoolKey(model, opts)
+
+	// a vocabulary-only load reads none of the weights, so it is left out
+	// of the budget
+	var size int64
+	if fi, err := os.Stat(model.ModelPath); err == nil && !opts.VocabOnly {
+		size = fi.Size()
+	}
+
+	p.mu.Lock()
+	e, err := p.reserve(key, size)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	e.mu.Lock()
+	if e.llm == nil && e.err == nil {
+		log.Printf("loading model %s", model.Name)
+		e.llm, e.err = p.load(model, opts)
+	}
+
+	if e.err != nil {
+		err := e.err
+		e.mu.Unlock()
+		p.release(e, 0)
+		return nil, nil, err
+	}
+
+	e.llm.SetOptions(opts)
+
+	var once sync.Once
+	return e.llm, func() {
+		once.Do(func() {
+			cacheSize := e.llm.CacheSize()
+			e.mu.Unlock()
+			p.release(e, cacheSize)
+		})
+	}, nil
+}
+
+// reserve finds or creates the entry for key, waiting for other models to be
+// released if the budget is exhausted. p.mu must be held.
+func (p *modelPool) reserve(key poolKey, size int64) (*poolEntry, error) {
+	for {
+		if e, ok := p.entries[key]; ok {
+			e.refs++
+			p.removeIdle(e)
+			return e, nil
+		}
+
+		if p.budget <= 0 || p.used+size <= p.budget || len(p.entries) == 0 {
+			e := &poolEntry{key: key, size: size, refs: 1}
+			p.entries[key] = e
+			p.used += size
+			return e, nil
+		}
+
+		if len(p.idle) > 0 {
+			p.unload(p.idle[0])
+			continue
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// release gives up a reference to e, whose model now holds cacheSize bytes
+// of saved states.
+func (p *modelPool) release(e *poolEntry, cacheSize int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.cond.Broadcast()
+
+	p.releaseLocked(e, cacheSize)
+}
+
+// releaseLocked is release with p.mu held.
+func (p *modelPool) releaseLocked(e *poolEntry, cacheSize int64) {
+	p.used += cacheSize - e.cacheSize
+	e.cacheSize = cacheSize
+
+	// the saved states may have grown past the budget, so unload other
+	// models that aren't in use
+	for p.budget > 0 && p.used > p.budget && len(p.idle) > 0 {
+		p.unload(p.idle[0])
+	}
+
+	e.refs--
+	if e.refs > 0 {
+		return
+	}
+
+	switch {
+	case e.err != nil, p.keepAlive == 0:
+		p.unload(e)
+	case p.keepAlive > 0:
+		p.idle = append(p.idle, e)
+		gen := e.timerGen
+		e.timer = time.AfterFunc(p.keepAlive, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			defer p.cond.Broadcast()
+
+			// the timer may have fired as e was reacquired, in which case
+			// a newer timer is responsible for it
+			if e.timerGen == gen && e.refs == 0 && p.entries[e.key] == e {
+				p.unload(e)
+			}
+		})
+	default:
+		p.idle = append(p.idle, e)
+	}
+}
+
+// unload frees an unused entry. p.mu must be held.
+func (p *modelPool) unload(e *poolEntry) {
+	p.removeIdle(e)
+	if p.entries[e.key] == e {
+		delete(p.entries, e.key)
+		p.used -= e.size + e.cacheSize
+	}
+
+	if e.llm != nil {
+		log.Printf("unloading model %s", e.key.digest)
+		e.llm.Close()
+		e.llm = nil
+	}
+}
+
+// removeIdle stops the expiry timer of e and removes it from the idle list.
+// p.mu must be held.
+func (p *modelPool) removeIdle(e *poolEntry) {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+		e.timerGen++
+	}
+
+	for i := range p.idle {
+		if p.idle[i] == e {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+}
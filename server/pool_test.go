@@ -0,0 +1,203 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+type fakeModel struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (m *fakeModel) SetOptions(api.Options) {}
+
+func (m *fakeModel) CacheSize() int64 { return 0 }
+
+func (m *fakeModel) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+}
+
+func (m *fakeModel) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// newTestPool returns a pool that loads fake models, and a function that
+// lists the models loaded so far.
+func newTestPool(t *testing.T, keepAlive time.Duration, budget int64) (*modelPool, func() []*fakeModel) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var loaded []*fakeModel
+
+	p := newModelPool(keepAlive, budget)
+	p.load = func(*Model, api.Options) (poolModel, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		m := &fakeModel{}
+		loaded = append(loaded, m)
+		return m, nil
+	}
+
+	return p, func() []*fakeModel {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*fakeModel(nil), loaded...)
+	}
+}
+
+// newTestModel returns a model whose weights are a file of size bytes.
+func newTestModel(t *testing.T, digest string, size int64) *Model {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), digest)
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Model{Name: digest, ModelPath: path, Digest: digest}
+}
+
+func acquire(t *testing.T, p *modelPool, model *Model, opts api.Options) (*fakeModel, func()) {
+	t.Helper()
+
+	llm, release, err := p.acquire(model, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return llm.(*fakeModel), release
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, loaded := newTestPool(t, time.Hour, 0)
+	model := newTestModel(t, "a", 10)
+	opts := api.DefaultOptions()
+
+	first, release := acquire(t, p, model, opts)
+	release()
+
+	second, release := acquire(t, p, model, opts)
+	release()
+
+	if first != second {
+		t.Error("expected the loaded model to be reused")
+	}
+
+	// load options need another instance of the model
+	opts.NumCtx *= 2
+	third, release := acquire(t, p, model, opts)
+	release()
+
+	if third == first {
+		t.Error("expected a model loaded with other options")
+	}
+
+	if n := len(loaded()); n != 2 {
+		t.Errorf("expected 2 loads, got %d", n)
+	}
+
+	if first.isClosed() || third.isClosed() {
+		t.Error("expected idle models to stay loaded")
+	}
+}
+
+func TestPoolBudget(t *testing.T) {
+	p, _ := newTestPool(t, time.Hour, 150)
+	a := newTestModel(t, "a", 100)
+	b := newTestModel(t, "b", 100)
+	opts := api.DefaultOptions()
+
+	// an idle model is unloaded to make room for another
+	first, release := acquire(t, p, a, opts)
+	release()
+
+	second, releaseSecond := acquire(t, p, b, opts)
+	if !first.isClosed() {
+		t.Error("expected the idle model to be unloaded")
+	}
+
+	// a model in use is waited for
+	acquired := make(chan *fakeModel)
+	go func() {
+		llm, release, err := p.acquire(a, opts)
+		if err != nil {
+			t.Error(err)
+			close(acquired)
+			return
+		}
+
+		acquired <- llm.(*fakeModel)
+		release()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected to wait for the model in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releaseSecond()
+
+	select {
+	case third := <-acquired:
+		if third == first {
+			t.Error("expected the unloaded model to be loaded again")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the model to be loaded once the other was released")
+	}
+
+	if !second.isClosed() {
+		t.Error("expected the released model to be unloaded")
+	}
+}
+
+func TestPoolKeepAlive(t *testing.T) {
+	const keepAlive = 100 * time.Millisecond
+
+	p, _ := newTestPool(t, keepAlive, 0)
+	model := newTestModel(t, "a", 10)
+	opts := api.DefaultOptions()
+
+	llm, release := acquire(t, p, model, opts)
+	release()
+
+	// the keep alive timer fires while the model is being reacquired, and
+	// waits for the pool until the model is released again
+	p.mu.Lock()
+	time.Sleep(2 * keepAlive)
+
+	e, err := p.reserve(newPoolKey(model, opts), 10)
+	if err != nil {
+		p.mu.Unlock()
+		t.Fatal(err)
+	}
+
+	p.releaseLocked(e, 0)
+	p.mu.Unlock()
+
+	time.Sleep(keepAlive / 2)
+	if llm.isClosed() {
+		t.Fatal("expected the stale keep alive timer to leave the model loaded")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !llm.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the model to be unloaded after the keep alive")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -16,9 +19,12 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/grammar"
 	"github.com/jmorganca/ollama/llama"
 )
 
+var pool *modelPool
+
 func cacheDir() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -28,6 +34,21 @@ func cacheDir() string {
 	return filepath.Join(home, ".ollama")
 }
 
+// modelOptions layers the model's parameters and then the request options
+// over the defaults.
+func modelOptions(model *Model, requestOpts api.Options) (api.Options, error) {
+	opts := api.DefaultOptions()
+	if err := mergo.Merge(&opts, model.Options, mergo.WithOverride); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := mergo.Merge(&opts, requestOpts, mergo.WithOverride); err != nil {
+		return api.Options{}, err
+	}
+
+	return opts, nil
+}
+
 func generate(c *gin.Context) {
 	start := time.Now()
 
@@ -37,23 +58,56 @@ func generate(c *gin.Context) {
 		return
 	}
 
+	g, err := grammar.FromFormat(req.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	model, err := GetModel(req.Model)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	opts := api.DefaultOptions()
-	if err := mergo.Merge(&opts, model.Options, mergo.WithOverride); err != nil {
+	opts, err := modelOptions(model, req.Options)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := mergo.Merge(&opts, req.Options, mergo.WithOverride); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if req.Stream != nil && !*req.Stream && opts.N > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "n requires a streaming response"})
 		return
 	}
 
+	var session *Session
+	unlock := func() {}
+	defer func() { unlock() }()
+	if req.Session != "" {
+		if !validSessionID(req.Session) {
+			c.JSON(http.StatusNotFound, gin.H{"error": errSessionNotFound.Error()})
+			return
+		}
+
+		unlock = lockSession(req.Session)
+		session, err = GetSession(req.Session)
+		if errors.Is(err, errSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if session.Digest != model.Digest {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("session %s belongs to model %s", session.ID, session.Model)})
+			return
+		}
+
+		req.Context = session.Context
+	}
+
 	templ, err := template.New("").Parse(model.Prompt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -67,30 +121,470 @@ func generate(c *gin.Context) {
 	}
 	req.Prompt = sb.String()
 
-	llm, err := llama.New(model.ModelPath, opts)
+	llm, release, err := pool.Acquire(model, opts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer llm.Close()
+
+	var statePath string
+	if session != nil {
+		statePath, err = session.StatePath()
+		if err != nil {
+			release()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := os.Stat(statePath); err == nil {
+			if err := llm.LoadSession(statePath, session.Context); err != nil {
+				release()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	// the session stays locked until generation finishes
+	unlockSession := unlock
+	unlock = func() {}
 
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		llm.Predict(req.Context, req.Prompt, func(r api.GenerateResponse) {
+		defer release()
+		defer unlockSession()
+
+		// stop generating as soon as the client goes away
+		ctx := c.Request.Context()
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+			}
+		}
+
+		fn := func(r api.GenerateResponse) {
 			r.Model = req.Model
 			r.CreatedAt = time.Now().UTC()
 			if r.Done {
 				r.TotalDuration = time.Since(start)
 			}
 
-			ch <- r
+			send(r)
+		}
+
+		if err := llm.Predict(ctx, req.Context, req.Prompt, g, fn); err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Printf("generate cancelled after %s", time.Since(start))
+				return
+			}
+
+			send(gin.H{"error": err.Error()})
+			return
+		}
+
+		if session != nil {
+			if err := llm.SaveSession(statePath); err != nil {
+				log.Printf("couldn't save session %s: %v", session.ID, err)
+				return
+			}
+
+			// the session resumes from the tokens in the saved kv cache
+			session.Context = llm.Context()
+			session.ModifiedAt = time.Now().UTC()
+
+			if err := session.Save(); err != nil {
+				log.Printf("couldn't save session %s: %v", session.ID, err)
+			}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		// join the response text and keep the final stats
+		var final api.GenerateResponse
+		var sb strings.Builder
+		var tokens []api.TokenLogprob
+		waitResponse(c, ch, func(v any) {
+			r := v.(api.GenerateResponse)
+			sb.WriteString(r.Response)
+			tokens = append(tokens, r.Tokens...)
+			final = r
+		}, func() any {
+			final.Response = sb.String()
+			final.Tokens = tokens
+			return final
 		})
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func chat(c *gin.Context) {
+	start := time.Now()
+
+	var req api.ChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "messages are required"})
+		return
+	}
+
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "user", "assistant":
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid message role %q", msg.Role)})
+			return
+		}
+	}
+
+	g, err := grammar.FromFormat(req.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts, err := modelOptions(model, req.Options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the whole conversation is rendered on every request; the kv cache
+	// still holds the turns it has in common with the previous request
+	prompt, err := model.ChatPrompt(req.Messages)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	llm, release, err := pool.Acquire(model, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		defer release()
+
+		ctx := c.Request.Context()
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+			}
+		}
+
+		fn := func(r api.GenerateResponse) {
+			resp := api.ChatResponse{
+				Model:              req.Model,
+				CreatedAt:          time.Now().UTC(),
+				Index:              r.Index,
+				Tokens:             r.Tokens,
+				Done:               r.Done,
+				DoneReason:         r.DoneReason,
+				PromptEvalCount:    r.PromptEvalCount,
+				PromptEvalDuration: r.PromptEvalDuration,
+				EvalCount:          r.EvalCount,
+				EvalDuration:       r.EvalDuration,
+			}
+
+			if r.Response != "" {
+				resp.Message = &api.Message{Role: "assistant", Content: r.Response}
+			}
+
+			if r.Done {
+				resp.TotalDuration = time.Since(start)
+			}
+
+			send(resp)
+		}
+
+		if err := llm.Predict(ctx, nil, prompt, g, fn); err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Printf("chat cancelled after %s", time.Since(start))
+				return
+			}
+
+			send(gin.H{"error": err.Error()})
+		}
 	}()
 
+	if req.Stream != nil && !*req.Stream {
+		// join the message content and keep the final stats
+		var final api.ChatResponse
+		var sb strings.Builder
+		var tokens []api.TokenLogprob
+		waitResponse(c, ch, func(v any) {
+			r := v.(api.ChatResponse)
+			if r.Message != nil {
+				sb.WriteString(r.Message.Content)
+			}
+
+			tokens = append(tokens, r.Tokens...)
+			final = r
+		}, func() any {
+			final.Message = &api.Message{Role: "assistant", Content: sb.String()}
+			final.Tokens = tokens
+			return final
+		})
+		return
+	}
+
 	streamResponse(c, ch)
 }
 
+func sessionResponse(s *Session) api.SessionResponse {
+	return api.SessionResponse{
+		ID:         s.ID,
+		Model:      s.Model,
+		Context:    s.Context,
+		CreatedAt:  s.CreatedAt,
+		ModifiedAt: s.ModifiedAt,
+	}
+}
+
+func createSession(c *gin.Context) {
+	var req api.SessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := CreateSession(req.Model, req.Context)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessionResponse(session))
+}
+
+func getSession(c *gin.Context) {
+	session, err := GetSession(c.Param("id"))
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessionResponse(session))
+}
+
+func deleteSession(c *gin.Context) {
+	if err := DeleteSession(c.Param("id")); errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func embeddings(c *gin.Context) {
+	var req api.EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Input) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "input is required"})
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts, err := modelOptions(model, req.Options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts.EmbeddingOnly = true
+
+	llm, release, err := pool.Acquire(model, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	resp := api.EmbeddingResponse{Model: req.Model}
+	for _, input := range req.Input {
+		embedding, err := llm.Embedding(input)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp.Embeddings = append(resp.Embeddings, embedding)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func score(c *gin.Context) {
+	var req api.ScoreRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Candidates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "candidates are required"})
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts, err := modelOptions(model, req.Options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts.LogitsAll = true
+
+	llm, release, err := pool.Acquire(model, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	scores, err := llm.Score(req.Prompt, req.Candidates)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ScoreResponse{Model: req.Model, Scores: scores})
+}
+
+// acquireVocab loads only the vocabulary of a model, which is enough to
+// convert between text and tokens.
+func acquireVocab(name string) (*llama.LLM, func(), error) {
+	model, err := GetModel(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts, err := modelOptions(model, api.Options{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts.VocabOnly = true
+	opts.NumGPU = 0
+	return pool.Acquire(model, opts)
+}
+
+func tokenize(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	llm, release, err := acquireVocab(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	tokens, err := llm.Tokenize(req.Prompt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Tokens: tokens})
+}
+
+func detokenize(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	llm, release, err := acquireVocab(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	prompt, err := llm.Detokenize(req.Tokens)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Prompt: prompt})
+}
+
+func vocab(c *gin.Context) {
+	var req api.VocabRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Offset < 0 || req.Limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset and limit must not be negative"})
+		return
+	}
+
+	llm, release, err := acquireVocab(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	entries := llm.Vocab()
+	resp := api.VocabResponse{Total: len(entries), Tokens: []api.VocabEntry{}}
+	if req.Offset < len(entries) {
+		entries = entries[req.Offset:]
+		if req.Limit > 0 && req.Limit < len(entries) {
+			entries = entries[:req.Limit]
+		}
+
+		resp.Tokens = entries
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 func pull(c *gin.Context) {
 	var req api.PullRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -111,11 +605,16 @@ func pull(c *gin.Context) {
 			}
 		}
 		if err := PullModel(req.Name, req.Username, req.Password, fn); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			ch <- gin.H{"error": err.Error()}
 		}
 	}()
 
+	if req.Stream != nil && !*req.Stream {
+		var last any
+		waitResponse(c, ch, func(v any) { last = v }, func() any { return last })
+		return
+	}
+
 	streamResponse(c, ch)
 }
 
@@ -139,11 +638,16 @@ func push(c *gin.Context) {
 			}
 		}
 		if err := PushModel(req.Name, req.Username, req.Password, fn); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			ch <- gin.H{"error": err.Error()}
 		}
 	}()
 
+	if req.Stream != nil && !*req.Stream {
+		var last any
+		waitResponse(c, ch, func(v any) { last = v }, func() any { return last })
+		return
+	}
+
 	streamResponse(c, ch)
 }
 
@@ -173,21 +677,117 @@ func create(c *gin.Context) {
 		}
 
 		if err := CreateModel(req.Name, file, fn); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
-			return
+			ch <- gin.H{"error": err.Error()}
 		}
 	}()
 
+	if req.Stream != nil && !*req.Stream {
+		var last any
+		waitResponse(c, ch, func(v any) { last = v }, func() any { return last })
+		return
+	}
+
 	streamResponse(c, ch)
 }
 
+func show(c *gin.Context) {
+	var req api.ShowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	manifest, err := GetManifest(ParseModelPath(req.Name))
+	if errors.Is(err, errModelNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, errInvalidModelPath) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	model, err := GetModel(req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	bts, err := json.Marshal(manifest)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ShowResponse{
+		Manifest:   bts,
+		Modelfile:  model.Modelfile(),
+		Prompt:     model.Prompt,
+		Template:   model.Template,
+		Parameters: model.Parameters(),
+	})
+}
+
+func copyModel(c *gin.Context) {
+	var req api.CopyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := CopyModel(req.Source, req.Destination); errors.Is(err, errModelNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, errInvalidModelPath) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func deleteModel(c *gin.Context) {
+	var req api.DeleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := DeleteModel(req.Name); errors.Is(err, errModelNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, errInvalidModelPath) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
 func list(c *gin.Context) {
-	var models []api.ListResponseModel
-	fp, err := GetManifestPath()
+	models, err := listModels()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+}
+
+func listModels() ([]api.ListResponseModel, error) {
+	var models []api.ListResponseModel
+	fp, err := GetManifestPath()
+	if err != nil {
+		return nil, err
+	}
 	err = filepath.Walk(fp, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -220,14 +820,19 @@ func list(c *gin.Context) {
 		return nil
 	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, api.ListResponse{models})
+	return models, nil
 }
 
 func Serve(ln net.Listener) error {
+	var err error
+	pool, err = newModelPoolFromEnv()
+	if err != nil {
+		return err
+	}
+
 	r := gin.Default()
 
 	r.GET("/", func(c *gin.Context) {
@@ -236,10 +841,27 @@ func Serve(ln net.Listener) error {
 
 	r.POST("/api/pull", pull)
 	r.POST("/api/generate", generate)
+	r.POST("/api/chat", chat)
+	r.POST("/api/embeddings", embeddings)
+	r.POST("/api/score", score)
+	r.POST("/api/tokenize", tokenize)
+	r.POST("/api/detokenize", detokenize)
+	r.POST("/api/vocab", vocab)
+	r.POST("/api/sessions", createSession)
+	r.GET("/api/sessions/:id", getSession)
+	r.DELETE("/api/sessions/:id", deleteSession)
 	r.POST("/api/create", create)
 	r.POST("/api/push", push)
+	r.POST("/api/show", show)
+	r.POST("/api/copy", copyModel)
+	r.DELETE("/api/delete", deleteModel)
 	r.GET("/api/tags", list)
 
+	r.POST("/v1/chat/completions", openaiChatCompletions)
+	r.POST("/v1/completions", openaiCompletions)
+	r.POST("/v1/embeddings", openaiEmbeddings)
+	r.GET("/v1/models", openaiModels)
+
 	log.Printf("Listening on %s", ln.Addr())
 	s := &http.Server{
 		Handler: r,
@@ -248,23 +870,75 @@ func Serve(ln net.Listener) error {
 	return s.Serve(ln)
 }
 
+// waitResponse reads the values sent on ch until it is closed, passing each
+// to add, and then writes the single value returned by done. If an error is
+// sent instead, it is written with an error status.
+func waitResponse(c *gin.Context, ch chan any, add func(any), done func() any) {
+	for val := range ch {
+		if h, ok := val.(gin.H); ok {
+			c.JSON(http.StatusInternalServerError, h)
+
+			// let the sender finish
+			for range ch {
+			}
+
+			return
+		}
+
+		add(val)
+	}
+
+	c.JSON(http.StatusOK, done())
+}
+
+// sseKeepAlive is how long a server-sent event stream may be idle before a
+// comment is sent to keep proxies from closing it.
+const sseKeepAlive = 15 * time.Second
+
+// streamResponse writes each value sent on ch as a line of JSON, or as a
+// server-sent event if the client accepts text/event-stream.
 func streamResponse(c *gin.Context, ch chan any) {
+	sse := strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+	}
+
+	// the keep-alive timer only fires for server-sent events
+	keepAlive := time.NewTimer(sseKeepAlive)
+	defer keepAlive.Stop()
+	if !sse {
+		keepAlive.Stop()
+	}
+
 	c.Stream(func(w io.Writer) bool {
-		val, ok := <-ch
-		if !ok {
-			return false
-		}
+		select {
+		case val, ok := <-ch:
+			if !ok {
+				return false
+			}
 
-		bts, err := json.Marshal(val)
-		if err != nil {
-			return false
-		}
+			bts, err := json.Marshal(val)
+			if err != nil {
+				return false
+			}
 
-		bts = append(bts, '\n')
-		if _, err := w.Write(bts); err != nil {
-			return false
-		}
+			if sse {
+				bts = append(append([]byte("data: "), bts...), '\n', '\n')
+				keepAlive.Reset(sseKeepAlive)
+			} else {
+				bts = append(bts, '\n')
+			}
 
-		return true
+			if _, err := w.Write(bts); err != nil {
+				return false
+			}
+
+			return true
+		case <-keepAlive.C:
+			keepAlive.Reset(sseKeepAlive)
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		}
 	})
 }
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEmbeddingsInput(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.POST("/api/embeddings", embeddings)
+
+	cases := []struct {
+		body string
+		want string
+	}{
+		// both shapes reach the model lookup
+		{`{"model": "missing", "input": "hello"}`, "couldn't find model"},
+		{`{"model": "missing", "input": ["hello", "world"]}`, "couldn't find model"},
+		{`{"model": "missing"}`, "input is required"},
+		{`{"model": "missing", "input": []}`, "input is required"},
+		{`{"model": "missing", "input": null}`, "input is required"},
+		{`{"model": "missing", "input": 1}`, "expected a string or a list of strings"},
+	}
+
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/embeddings", strings.NewReader(tt.body)))
+
+		var resp struct {
+			Error string `json:"error"`
+		}
+
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(resp.Error, tt.want) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.body, w.Code, resp.Error, http.StatusBadRequest, tt.want)
+		}
+	}
+}
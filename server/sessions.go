@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// Session is a conversation whose kv cache is kept on disk so generation can
+// resume from it. The metadata is stored in <id>.json and the kv cache in
+// <id>.bin under ~/.ollama/sessions.
+type Session struct {
+	ID         string    `json:"id"`
+	Model      string    `json:"model"`
+	Digest     string    `json:"digest"`
+	Context    []int     `json:"context,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+type sessionLock struct {
+	sync.Mutex
+	// refs is the number of requests holding or waiting for the lock
+	refs int
+}
+
+var (
+	sessionLocksMu sync.Mutex
+	// sessionLocks holds the locks of sessions in use, which are removed
+	// once no request holds or waits for them
+	sessionLocks = make(map[string]*sessionLock)
+)
+
+// lockSession serializes requests that use the same session. id must be a
+// valid session ID.
+func lockSession(id string) func() {
+	sessionLocksMu.Lock()
+	l, ok := sessionLocks[id]
+	if !ok {
+		l = &sessionLock{}
+		sessionLocks[id] = l
+	}
+
+	l.refs++
+	sessionLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		sessionLocksMu.Lock()
+		defer sessionLocksMu.Unlock()
+
+		if l.refs--; l.refs == 0 {
+			delete(sessionLocks, id)
+		}
+	}
+}
+
+// validSessionID reports whether id has the form of the IDs CreateSession
+// generates.
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func GetSessionsPath() (string, error) {
+	path := filepath.Join(cacheDir(), "sessions")
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func sessionPath(id, ext string) (string, error) {
+	if !validSessionID(id) {
+		return "", errSessionNotFound
+	}
+
+	dir, err := GetSessionsPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, id+ext), nil
+}
+
+// StatePath returns the path of the session's kv cache.
+func (s *Session) StatePath() (string, error) {
+	return sessionPath(s.ID, ".bin")
+}
+
+func CreateSession(name string, context []int) (*Session, error) {
+	model, err := GetModel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:         hex.EncodeToString(b),
+		Model:      name,
+		Digest:     model.Digest,
+		Context:    context,
+		CreatedAt:  now,
+		ModifiedAt: now,
+	}
+
+	if err := session.Save(); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func GetSession(id string) (*Session, error) {
+	fp, err := sessionPath(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(bts, &session); err != nil {
+		return nil, fmt.Errorf("session %s: %w", id, err)
+	}
+
+	return &session, nil
+}
+
+// Save writes the session metadata. The kv cache is written separately to
+// StatePath.
+func (s *Session) Save() error {
+	fp, err := sessionPath(s.ID, ".json")
+	if err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file so a crash never leaves a truncated session
+	if err := os.WriteFile(fp+".tmp", bts, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(fp+".tmp", fp)
+}
+
+func DeleteSession(id string) error {
+	if !validSessionID(id) {
+		return errSessionNotFound
+	}
+
+	unlock := lockSession(id)
+	defer unlock()
+
+	fp, err := sessionPath(id, ".json")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(fp); errors.Is(err, os.ErrNotExist) {
+		return errSessionNotFound
+	} else if err != nil {
+		return err
+	}
+
+	state, err := sessionPath(id, ".bin")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(state); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}